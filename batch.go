@@ -0,0 +1,132 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// BatchError reports the items of a batch that failed, keyed by item index.
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d batch items failed", len(e.Errors))
+}
+
+// SendBatch POSTs items as a JSON array and decodes the JSON array response
+// into the slice pointed to by resultTarget, one result per item. Results
+// that can't be decoded or carry a "status" field >= 400 are reported in a
+// *BatchError, while the other results are still decoded. r is left as is,
+// the batch is sent by a copy of it.
+func (r *Rattle) SendBatch(items []interface{}, resultTarget interface{}) (int, error) {
+	v := reflect.ValueOf(resultTarget)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return 0, fmt.Errorf("resultTarget must be a pointer to a slice, got %T", resultTarget)
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+	batch := r.New().BodyJSON(items, true)
+	batch.method = POST
+	result, code, err := batch.Send()
+	if err != nil {
+		return code, err
+	}
+	if code >= 400 {
+		return code, fmt.Errorf("%s", batch.resp.Status)
+	}
+
+	var raws []json.RawMessage
+	if err = json.Unmarshal(result, &raws); err != nil {
+		return code, err
+	}
+	if len(raws) != len(items) {
+		return code, fmt.Errorf("batch of %d items returned %d results", len(items), len(raws))
+	}
+	slice := reflect.MakeSlice(v.Elem().Type(), len(raws), len(raws))
+	batchErr := &BatchError{Errors: make(map[int]error)}
+	for i, raw := range raws {
+		if err = json.Unmarshal(raw, slice.Index(i).Addr().Interface()); err != nil {
+			batchErr.Errors[i] = err
+			continue
+		}
+		if status, err := strconv.Atoi(jsonField(raw, "status")); err == nil && status >= 400 {
+			batchErr.Errors[i] = fmt.Errorf("item status %d", status)
+		}
+	}
+	v.Elem().Set(slice)
+	if len(batchErr.Errors) > 0 {
+		return code, batchErr
+	}
+	return code, nil
+}
+
+// SendResult is the outcome of one request sent by SendAll.
+type SendResult struct {
+	Result []byte
+	Code   int
+	Err    error
+}
+
+// SendAll sends the requests of rattles, at most concurrency at a time or
+// all at once if concurrency <= 0, and returns their results in order.
+// Cancelling ctx cancels the requests in flight and stops issuing new ones,
+// the results of those carry the error of ctx. Each rattle is used by one
+// goroutine, so they must be distinct.
+func SendAll(ctx context.Context, rattles []*Rattle, concurrency int) []SendResult {
+	results := make([]SendResult, len(rattles))
+	if concurrency <= 0 {
+		concurrency = len(rattles)
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, rattle := range rattles {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			for j := i; j < len(rattles); j++ {
+				results[j].Err = err
+			}
+			break
+		}
+		wg.Add(1)
+		go func(i int, rattle *Rattle) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			req, err := rattle.GetRequest()
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i].Result, results[i].Code, results[i].Err = rattle.DoWithContext(ctx, req)
+		}(i, rattle)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+type testBatchResult struct {
+	ID     int `json:"id"`
+	Status int `json:"status"`
+}
+
+func TestSendBatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != POST {
+			t.Errorf("expected method %s, got %s", POST, req.Method)
+		}
+		var items []testItem
+		if err := json.NewDecoder(req.Body).Decode(&items); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		results := make([]testBatchResult, len(items))
+		for i, item := range items {
+			results[i] = testBatchResult{ID: item.ID, Status: http.StatusCreated}
+			if item.Name == "" {
+				results[i].Status = http.StatusUnprocessableEntity
+			}
+		}
+		_ = json.NewEncoder(w).Encode(results)
+	}))
+	defer ts.Close()
+
+	var results []testBatchResult
+	items := []interface{}{testItem{1, "a"}, testItem{2, "b"}, testItem{3, "c"}}
+	client := New().BaseURL(ts.URL)
+	code, err := client.SendBatch(items, &results)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if len(results) != len(items) {
+		t.Fatalf("expected %d results, got %d", len(items), len(results))
+	}
+	for i, result := range results {
+		if result.ID != i+1 || result.Status != http.StatusCreated {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+	}
+
+	items = []interface{}{testItem{1, "a"}, testItem{2, ""}, testItem{3, "c"}}
+	if client.method != GET || client.bodyProvider != nil {
+		t.Errorf("expected the client left unchanged, got %s with body %v", client.method, client.bodyProvider)
+	}
+	_, err = client.SendBatch(items, &results)
+	batchErr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("expected *BatchError, got %v", err)
+	}
+	if len(batchErr.Errors) != 1 || batchErr.Errors[1] == nil {
+		t.Errorf("expected item 1 to fail, got %v", batchErr.Errors)
+	}
+	if len(results) != 3 || results[2].ID != 3 {
+		t.Errorf("expected the other results to be decoded, got %+v", results)
+	}
+}
+
+func TestSendAll(t *testing.T) {
+	var arrived int32
+	started := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&arrived, 1)
+		if req.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-req.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte(req.URL.Path))
+	}))
+	defer ts.Close()
+
+	results := SendAll(context.Background(), []*Rattle{New().Get(ts.URL + "/a"), New().Get(ts.URL + "/b")}, 1)
+	for i, expected := range []string{"/a", "/b"} {
+		if results[i].Err != nil || string(results[i].Result) != expected || results[i].Code != http.StatusOK {
+			t.Errorf("expected result %d %s, got %+v", i, expected, results[i])
+		}
+	}
+
+	atomic.StoreInt32(&arrived, 0)
+	var rattles []*Rattle
+	for i := 0; i < 6; i++ {
+		rattles = append(rattles, New().Get(ts.URL+"/slow"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		<-started
+		cancel()
+	}()
+	results = SendAll(ctx, rattles, 2)
+	for i, result := range results {
+		if !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("expected result %d context.Canceled, got %v", i, result.Err)
+		}
+	}
+	if n := atomic.LoadInt32(&arrived); n != 2 {
+		t.Errorf("expected only the 2 requests in flight issued, got %d", n)
+	}
+}
@@ -18,13 +18,26 @@ package rattle
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	goquery "github.com/google/go-querystring/query"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
 )
 
 // BodyProvider provides Body content for http.Request attachment.
@@ -33,6 +46,168 @@ type BodyProvider interface {
 	GetBody() (io.Reader, string, error)
 }
 
+// bodyGetter returns a func producing the body of p again, used to resend
+// it on retries, or nil if p can't do so. Original bodies can be produced
+// again if they are an io.Seeker, the others are built by p once more.
+func bodyGetter(p BodyProvider) func() (io.ReadCloser, error) {
+	if o, ok := p.(bodyOriginalProvider); ok {
+		seeker, ok := o.body.(io.Seeker)
+		if !ok {
+			return nil
+		}
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil
+		}
+		return func() (io.ReadCloser, error) {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(o.body), nil
+		}
+	}
+	return func() (io.ReadCloser, error) {
+		body, _, err := p.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		if rc, ok := body.(io.ReadCloser); ok {
+			return rc, nil
+		}
+		return ioutil.NopCloser(body), nil
+	}
+}
+
+// ErrBodyDeadline is returned reading request bodies past their deadline,
+// see Rattle.BodyDeadline.
+var ErrBodyDeadline = errors.New("request body deadline exceeded")
+
+// deadlineReader fails reads of body once deadline passes or ctx is done,
+// even while the wrapped reader is blocked. A single goroutine reads body,
+// on demand, so a read abandoned at the deadline is left to it alone.
+type deadlineReader struct {
+	body io.ReadCloser
+	ctx  context.Context
+	err  error
+
+	timer   *time.Timer
+	want    chan int // sizes of the reads asked of readLoop
+	results chan readResult
+	stop    chan struct{}
+	closed  sync.Once
+}
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+func newDeadlineReader(body io.ReadCloser, ctx context.Context, deadline time.Time) *deadlineReader {
+	d := &deadlineReader{
+		body:    body,
+		ctx:     ctx,
+		timer:   time.NewTimer(time.Until(deadline)),
+		want:    make(chan int, 1),
+		results: make(chan readResult, 1),
+		stop:    make(chan struct{}),
+	}
+	go d.readLoop()
+	return d
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	d.want <- len(p)
+	select {
+	case res := <-d.results:
+		// readLoop leaves its buffer alone until it's asked for the next read
+		if res.err != nil {
+			d.err = res.err
+		}
+		return copy(p, res.buf), res.err
+	case <-d.timer.C:
+		d.err = ErrBodyDeadline
+	case <-d.ctx.Done():
+		d.err = d.ctx.Err()
+	case <-d.stop:
+		d.err = io.ErrClosedPipe
+	}
+	return 0, d.err
+}
+
+// readLoop reads body into its own buffer as asked by Read, which may give
+// up on a read while it blocks, until body fails or the reader is closed.
+func (d *deadlineReader) readLoop() {
+	var buf []byte
+	for {
+		select {
+		case size := <-d.want:
+			if cap(buf) < size {
+				buf = make([]byte, size)
+			}
+			n, err := d.body.Read(buf[:size])
+			d.results <- readResult{buf[:n], err}
+			if err != nil {
+				return
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *deadlineReader) Close() error {
+	d.closed.Do(func() {
+		d.timer.Stop()
+		close(d.stop)
+	})
+	return d.body.Close()
+}
+
+// gzipIfLarger reads body and gzips it if it's larger than threshold bytes.
+// It reports whether the returned body is compressed. A body that is an
+// io.Closer, e.g. a file, is closed once read.
+func gzipIfLarger(body io.Reader, threshold int) (io.Reader, bool, error) {
+	raw, err := ioutil.ReadAll(body)
+	if closer, ok := body.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(raw) <= threshold {
+		return bytes.NewReader(raw), false, nil
+	}
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err = writer.Write(raw); err != nil {
+		return nil, false, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, false, err
+	}
+	return bytes.NewReader(buf.Bytes()), true, nil
+}
+
+// gzipGetter returns getBody with the bodies it produces gzipped.
+func gzipGetter(getBody func() (io.ReadCloser, error)) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+		compressed, _, err := gzipIfLarger(body, -1)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(compressed), nil
+	}
+}
+
 // bodyOriginalProvider provides the wrapped body value as a Body for requests.
 type bodyOriginalProvider struct {
 	body io.Reader
@@ -60,10 +235,27 @@ func (p bodyProviderJson) GetBody() (io.Reader, string, error) {
 	return buf, contentTypeJson, nil
 }
 
+// xmlBodyProvider encodes a XML tagged struct value as a Body for requests,
+// after the standard XML header.
+// See https://golang.org/pkg/encoding/xml/#Marshal for details.
+type bodyProviderXml struct {
+	body interface{}
+}
+
+func (p bodyProviderXml) GetBody() (io.Reader, string, error) {
+	buf := bytes.NewBufferString(xml.Header)
+	err := xml.NewEncoder(buf).Encode(p.body)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, contentTypeXml, nil
+}
+
 // formBodyProvider encodes a url tagged struct value as Body for requests.
 // See https://godoc.org/github.com/google/go-querystring/query for details.
 type bodyProviderForm struct {
-	body interface{}
+	body          interface{}
+	preserveOrder bool
 }
 
 func (p bodyProviderForm) GetBody() (io.Reader, string, error) {
@@ -71,38 +263,178 @@ func (p bodyProviderForm) GetBody() (io.Reader, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
+	if p.preserveOrder {
+		return strings.NewReader(encodeOrdered(values, formKeys(p.body))), contentTypeForm, nil
+	}
 	return strings.NewReader(values.Encode()), contentTypeForm, nil
 }
 
+// encodeOrdered encodes values like url.Values.Encode, but with the given
+// keys first in their order. Any other keys follow sorted.
+func encodeOrdered(values url.Values, keys []string) string {
+	var buf strings.Builder
+	write := func(key string) {
+		for _, value := range values[key] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(key))
+			buf.WriteByte('=')
+			buf.WriteString(url.QueryEscape(value))
+		}
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			write(key)
+		}
+	}
+	rest := make([]string, 0, len(values))
+	for key := range values {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		write(key)
+	}
+	return buf.String()
+}
+
+// formKeys returns the url tagged keys of the struct v in field order,
+// including those of embedded structs.
+func formKeys(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("url")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			keys = append(keys, formKeys(reflect.Zero(field.Type).Interface())...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// bodyProviderFormPairs encodes key/value pairs as form Body for requests,
+// in their order.
+type bodyProviderFormPairs struct {
+	pairs [][2]string
+}
+
+func (p bodyProviderFormPairs) GetBody() (io.Reader, string, error) {
+	var buf strings.Builder
+	for i, pair := range p.pairs {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(url.QueryEscape(pair[0]))
+		buf.WriteByte('=')
+		buf.WriteString(url.QueryEscape(pair[1]))
+	}
+	return strings.NewReader(buf.String()), contentTypeForm, nil
+}
+
+// bodyProviderProto encodes a protobuf message as Body for requests.
+type bodyProviderProto struct {
+	body proto.Message
+}
+
+func (p bodyProviderProto) GetBody() (io.Reader, string, error) {
+	b, err := proto.Marshal(p.body)
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(b), contentTypeProtobuf, nil
+}
+
+// bodyProviderMsgPack encodes a value as MessagePack Body for requests.
+type bodyProviderMsgPack struct {
+	body interface{}
+}
+
+func (p bodyProviderMsgPack) GetBody() (io.Reader, string, error) {
+	b, err := msgpack.Marshal(p.body)
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(b), contentTypeMsgPack, nil
+}
+
+// bodyProviderFunc defers building the body until the request is sent.
+type bodyProviderFunc struct {
+	fn func() (io.Reader, string, error)
+}
+
+func (p *bodyProviderFunc) GetBody() (io.Reader, string, error) {
+	return p.fn()
+}
+
 type bodyProviderFileStruct struct {
 	fileName  string
 	fieldName string
 	file      io.Reader
 }
 
+// NewBodyFile returns the file for BodyFile, sent as form field fieldName
+// with the given fileName and the content read from file.
+func NewBodyFile(fieldName, fileName string, file io.Reader) bodyProviderFileStruct {
+	return bodyProviderFileStruct{fileName: fileName, fieldName: fieldName, file: file}
+}
+
 type bodyProviderFile struct {
-	body interface{}
-	file bodyProviderFileStruct
+	body     interface{}
+	files    []bodyProviderFileStruct
+	boundary string
 }
 
 func (p bodyProviderFile) GetBody() (io.Reader, string, error) {
-	if p.file.fileName == "" {
-		return nil, "", fmt.Errorf("%s not defined", "fileName")
+	if len(p.files) == 0 {
+		return nil, "", fmt.Errorf("%s not defined", "file")
 	}
-	if p.file.fieldName == "" {
-		return nil, "", fmt.Errorf("%s not defined", "fieldName")
+	for _, file := range p.files {
+		if file.fileName == "" {
+			return nil, "", fmt.Errorf("%s not defined", "fileName")
+		}
+		if file.fieldName == "" {
+			return nil, "", fmt.Errorf("%s not defined", "fieldName")
+		}
 	}
 
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
-	fw, err := writer.CreateFormFile(p.file.fieldName, p.file.fileName)
-	if err != nil {
-		return nil, "", fmt.Errorf("CreateFormFile %v", err)
+	if p.boundary != "" {
+		if err := writer.SetBoundary(p.boundary); err != nil {
+			return nil, "", fmt.Errorf("SetBoundary %v", err)
+		}
 	}
+	for _, file := range p.files {
+		fw, err := writer.CreateFormFile(file.fieldName, file.fileName)
+		if err != nil {
+			return nil, "", fmt.Errorf("CreateFormFile %v", err)
+		}
 
-	_, err = io.Copy(fw, p.file.file)
-	if err != nil {
-		return nil, "", fmt.Errorf("copying fileWriter %v", err)
+		_, err = io.Copy(fw, file.file)
+		if err != nil {
+			return nil, "", fmt.Errorf("copying fileWriter %v", err)
+		}
 	}
 
 	if p.body != nil {
@@ -118,10 +450,30 @@ func (p bodyProviderFile) GetBody() (io.Reader, string, error) {
 		}
 	}
 
-	err = writer.Close() // close writer before POST request
+	err := writer.Close() // close writer before POST request
 	if err != nil {
 		return nil, "", fmt.Errorf("writerClose: %v", err)
 	}
 
 	return body, writer.FormDataContentType(), nil
 }
+
+// sniffContentType detects the content type of body from its first 512
+// bytes, see http.DetectContentType. Seekable bodies are rewound, others are
+// returned with the sniffed bytes in front of the rest.
+func sniffContentType(body io.Reader) (io.Reader, string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", err
+	}
+	head = head[:n]
+	if seeker, ok := body.(io.Seeker); ok {
+		if _, err = seeker.Seek(int64(-n), io.SeekCurrent); err != nil {
+			return nil, "", err
+		}
+	} else {
+		body = io.MultiReader(bytes.NewReader(head), body)
+	}
+	return body, http.DetectContentType(head), nil
+}
@@ -0,0 +1,374 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type testUploadFields struct {
+	Title string `url:"title"`
+}
+
+func TestBodyFile(t *testing.T) {
+	content := bytes.Repeat([]byte("rattle\x00\xff"), 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		file, header, err := req.FormFile("upload")
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+		defer file.Close()
+		received, _ := ioutil.ReadAll(file)
+		if header.Filename != "report.bin" {
+			t.Errorf("expected file name report.bin, got %s", header.Filename)
+		}
+		if !bytes.Equal(content, received) {
+			t.Errorf("expected %d bytes of file content, got %d", len(content), len(received))
+		}
+		if title := req.FormValue("title"); title != "monthly" {
+			t.Errorf("expected title monthly, got %s", title)
+		}
+	}))
+	defer ts.Close()
+
+	file := NewBodyFile("upload", "report.bin", bytes.NewReader(content))
+	_, code, err := New().Post(ts.URL).BodyFile(testUploadFields{Title: "monthly"}, file).Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+}
+
+// stallReader returns one chunk, then blocks until unblock is closed.
+type stallReader struct {
+	sent    bool
+	unblock chan struct{}
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if !s.sent {
+		s.sent = true
+		return copy(p, "partial"), nil
+	}
+	<-s.unblock
+	return 0, io.EOF
+}
+
+func TestDeadlineReader(t *testing.T) {
+	content := bytes.Repeat([]byte("deadline"), 8192)
+	reader := newDeadlineReader(ioutil.NopCloser(bytes.NewReader(content)), context.Background(), time.Now().Add(time.Minute))
+	goroutines := runtime.NumGoroutine()
+	var read []byte
+	buf := make([]byte, 16)
+	for {
+		n, err := reader.Read(buf)
+		read = append(read, buf[:n]...)
+		if n := runtime.NumGoroutine(); n > goroutines {
+			t.Fatalf("expected no goroutine per read, got %d after %d", n, goroutines)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if !bytes.Equal(read, content) {
+		t.Errorf("expected the body read whole, got %d of %d bytes", len(read), len(content))
+	}
+
+	// a read blocked past the deadline is left to the reading goroutine,
+	// which closing the body releases
+	pr, _ := io.Pipe()
+	reader = newDeadlineReader(pr, context.Background(), time.Now().Add(20*time.Millisecond))
+	for i := 0; i < 2; i++ {
+		if _, err := reader.Read(buf); err != ErrBodyDeadline {
+			t.Errorf("expected ErrBodyDeadline, got %v", err)
+		}
+	}
+	_ = reader.Close()
+	if !waitFor(func() bool { return runtime.NumGoroutine() < goroutines }) {
+		t.Errorf("expected the reading goroutine to end once closed")
+	}
+}
+
+func TestBodyDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer ts.Close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	start := time.Now()
+	_, _, err := New().Post(ts.URL).BodyOriginal(&stallReader{unblock: unblock}).
+		BodyDeadline(50 * time.Millisecond).Send()
+	if !errors.Is(err, ErrBodyDeadline) {
+		t.Errorf("expected ErrBodyDeadline, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the send to abort at the deadline, took %v", elapsed)
+	}
+
+	// cancelling the context aborts before the deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, _, err = New().Post(ts.URL).BodyOriginal(&stallReader{unblock: unblock}).
+		BodyDeadline(time.Minute).WithContext(ctx).Send()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// bodies produced in time are sent whole
+	result, _, err := New().Post(ts.URL).BodyJSON("fast", false).BodyDeadline(time.Second).Send()
+	if err != nil || result == nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCompressBodyIfLarger(t *testing.T) {
+	type received struct {
+		encoding string
+		body     []byte
+	}
+	var got received
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got.encoding = req.Header.Get("Content-Encoding")
+		got.body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer ts.Close()
+
+	small := bytes.Repeat([]byte("s"), 100)
+	if _, _, err := New().Post(ts.URL).BodyOriginal(bytes.NewReader(small)).CompressBodyIfLarger(1024).Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got.encoding != "" || !bytes.Equal(got.body, small) {
+		t.Errorf("expected the small body uncompressed, got %q encoding and %d bytes", got.encoding, len(got.body))
+	}
+
+	large := bytes.Repeat([]byte("l"), 4096)
+	if _, _, err := New().Post(ts.URL).BodyOriginal(bytes.NewReader(large)).CompressBodyIfLarger(1024).Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got.encoding != "gzip" || len(got.body) >= len(large) {
+		t.Fatalf("expected the large body gzipped, got %q encoding and %d bytes", got.encoding, len(got.body))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(got.body))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if plain, _ := ioutil.ReadAll(reader); !bytes.Equal(plain, large) {
+		t.Errorf("expected the large body after decompression, got %d bytes", len(plain))
+	}
+}
+
+// closeRecorder records whether it has been closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCompressBodyIfLarger_close(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	for _, size := range []int{100, 4096} {
+		body := &closeRecorder{Reader: bytes.NewReader(bytes.Repeat([]byte("c"), size))}
+		if _, _, err := New().Post(ts.URL).BodyOriginal(body).CompressBodyIfLarger(1024).Send(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !body.closed {
+			t.Errorf("expected the body of %d bytes closed once read", size)
+		}
+	}
+}
+
+type testSignedForm struct {
+	Timestamp int64  `url:"timestamp"`
+	Nonce     string `url:"nonce"`
+	Amount    string `url:"amount"`
+	Skipped   string `url:"-"`
+	Memo      string `url:"memo,omitempty"`
+}
+
+func TestBodyForm_preserveOrder(t *testing.T) {
+	form := testSignedForm{Timestamp: 1538380800, Nonce: "x y", Amount: "9.99", Skipped: "no"}
+	cases := map[bool]string{
+		false: "amount=9.99&nonce=x+y&timestamp=1538380800",
+		true:  "timestamp=1538380800&nonce=x+y&amount=9.99",
+	}
+	for preserveOrder, expected := range cases {
+		config := NewConfig()
+		config.FormPreserveOrder = preserveOrder
+		req, err := New(config).Post("http://example.com").BodyForm(form).GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) != expected {
+			t.Errorf("preserveOrder %v: expected %s, got %s", preserveOrder, expected, body)
+		}
+		if ct := req.Header.Get(contentType); ct != contentTypeForm {
+			t.Errorf("expected content type %s, got %s", contentTypeForm, ct)
+		}
+	}
+}
+
+func TestBodyFormOrdered(t *testing.T) {
+	pairs := [][2]string{{"timestamp", "1538380800"}, {"nonce", "x y"}, {"tag", "b&c"}, {"amount", "9.99"}, {"tag", "a"}}
+	req, err := New().Post("http://example.com").BodyFormOrdered(pairs).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	expected := "timestamp=1538380800&nonce=x+y&tag=b%26c&amount=9.99&tag=a"
+	if !bytes.Equal(body, []byte(expected)) {
+		t.Errorf("expected %s, got %s", expected, body)
+	}
+	if ct := req.Header.Get(contentType); ct != contentTypeForm {
+		t.Errorf("expected content type %s, got %s", contentTypeForm, ct)
+	}
+}
+
+type testEnvelope struct {
+	XMLName xml.Name `xml:"envelope"`
+	Action  string   `xml:"action,attr"`
+	Item    string   `xml:"body>item"`
+}
+
+func TestBodyXML(t *testing.T) {
+	req, err := New().Post("http://example.com").BodyXML(testEnvelope{Action: "create", Item: "a<b"}).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	expected := xml.Header + `<envelope action="create"><body><item>a&lt;b</item></body></envelope>`
+	if string(body) != expected {
+		t.Errorf("expected %s, got %s", expected, body)
+	}
+	if ct := req.Header.Get(contentType); ct != contentTypeXml {
+		t.Errorf("expected content type %s, got %s", contentTypeXml, ct)
+	}
+
+	// nil keeps the previous body
+	rattle := New().Post("http://example.com").BodyJSON("kept", false).BodyXML(nil)
+	if _, ok := rattle.bodyProvider.(bodyProviderJson); !ok {
+		t.Errorf("expected BodyXML(nil) to keep the JSON body, got %T", rattle.bodyProvider)
+	}
+}
+
+type testProfileFields struct {
+	Name  string `url:"name"`
+	Email string `url:"email"`
+}
+
+func TestBodyFiles(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("unexpected error %v", err)
+			return
+		}
+		form := req.MultipartForm
+		for field, expected := range map[string]string{"name": "rattle", "email": "rattle@example.com"} {
+			if got := form.Value[field]; len(got) != 1 || got[0] != expected {
+				t.Errorf("expected field %s=%s, got %v", field, expected, got)
+			}
+		}
+		for field, expected := range map[string][2]string{"avatar": {"me.png", "png"}, "document": {"cv.pdf", "pdf"}} {
+			headers := form.File[field]
+			if len(headers) != 1 || headers[0].Filename != expected[0] {
+				t.Errorf("expected file %s named %s, got %v", field, expected[0], headers)
+				continue
+			}
+			file, _ := headers[0].Open()
+			content, _ := ioutil.ReadAll(file)
+			_ = file.Close()
+			if string(content) != expected[1] {
+				t.Errorf("expected content %s of %s, got %s", expected[1], field, content)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	fields := testProfileFields{Name: "rattle", Email: "rattle@example.com"}
+	_, code, err := New().Post(ts.URL).BodyFiles(fields,
+		NewBodyFile("avatar", "me.png", bytes.NewReader([]byte("png"))),
+		NewBodyFile("document", "cv.pdf", bytes.NewReader([]byte("pdf"))),
+	).Send()
+	if err != nil || code != http.StatusOK {
+		t.Errorf("unexpected result %d %v", code, err)
+	}
+
+	if _, err = New().Post(ts.URL).BodyFiles(fields).GetRequest(); err == nil {
+		t.Errorf("expected error without files")
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 1024)...)
+	var gotType string
+	var gotBody []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotType = req.Header.Get(contentType)
+		gotBody, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.SniffContentType = true
+	bodies := map[string]io.Reader{
+		"seeker":    bytes.NewReader(png),
+		"no seeker": onlyReader{bytes.NewReader(png)},
+	}
+	for name, body := range bodies {
+		if _, _, err := New(config).Post(ts.URL).BodyOriginal(body).Send(); err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if gotType != "image/png" {
+			t.Errorf("%s: expected image/png, got %q", name, gotType)
+		}
+		if !bytes.Equal(gotBody, png) {
+			t.Errorf("%s: expected the whole body sent, got %d bytes", name, len(gotBody))
+		}
+	}
+
+	if _, _, err := New().Post(ts.URL).BodyOriginal(bytes.NewReader(png)).Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if gotType != "" {
+		t.Errorf("expected no content type without SniffContentType, got %q", gotType)
+	}
+}
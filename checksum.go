@@ -0,0 +1,78 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// checksumHeader checks response bodies against the digest in a header,
+// see VerifyChecksumHeader.
+type checksumHeader struct {
+	header  string
+	algo    string
+	newHash func() hash.Hash
+}
+
+// VerifyChecksumHeader makes Do compute the algo digest of the response
+// body, md5, sha1, sha256 or sha512, and compare it to the response header
+// named header, e.g. VerifyChecksumHeader("X-Checksum-Sha256", "sha256").
+// The header holds the digest in hex or base64. A missing header or a
+// mismatch is returned as error, along with the body.
+func (r *Rattle) VerifyChecksumHeader(header, algo string) *Rattle {
+	var newHash func() hash.Hash
+	switch strings.ToLower(strings.Replace(algo, "-", "", 1)) {
+	case "md5":
+		newHash = md5.New
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return r.setErr(fmt.Errorf("VerifyChecksumHeader: algorithm %s not supported", algo))
+	}
+	r.checksum = &checksumHeader{header: header, algo: algo, newHash: newHash}
+	return r
+}
+
+// verify returns an error unless body matches the checksum header of resp.
+func (c *checksumHeader) verify(resp *http.Response, body []byte) error {
+	expected := strings.TrimSpace(resp.Header.Get(c.header))
+	if expected == "" {
+		return fmt.Errorf("checksum header %s not defined", c.header)
+	}
+	sum := c.newHash()
+	_, _ = sum.Write(body)
+	digest := sum.Sum(nil)
+	if strings.EqualFold(expected, hex.EncodeToString(digest)) ||
+		expected == base64.StdEncoding.EncodeToString(digest) ||
+		expected == base64.RawStdEncoding.EncodeToString(digest) {
+		return nil
+	}
+	return fmt.Errorf("%s checksum mismatch: %s is %s, body is %x", c.algo, c.header, expected, digest)
+}
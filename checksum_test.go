@@ -0,0 +1,62 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyChecksumHeader(t *testing.T) {
+	body := []byte("content from the edge")
+	sum := sha256.Sum256(body)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/hex":
+			w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+		case "/base64":
+			w.Header().Set("X-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum[:]))
+		case "/wrong":
+			w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(make([]byte, sha256.Size)))
+		}
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/hex", "/base64"} {
+		result, _, err := New().Get(ts.URL+path).VerifyChecksumHeader("X-Checksum-Sha256", "sha256").Send()
+		if err != nil || string(result) != string(body) {
+			t.Errorf("%s: expected the checksum verified, got %q %v", path, result, err)
+		}
+	}
+	for _, path := range []string{"/wrong", "/missing"} {
+		if _, _, err := New().Get(ts.URL+path).VerifyChecksumHeader("X-Checksum-Sha256", "sha256").Send(); err == nil {
+			t.Errorf("%s: expected checksum error", path)
+		}
+	}
+
+	if _, _, err := New().Get(ts.URL + "/wrong").Send(); err != nil {
+		t.Errorf("expected no verification by default, got %v", err)
+	}
+	if err := New().VerifyChecksumHeader("X-Checksum", "crc32").Err(); err == nil {
+		t.Errorf("expected error for unsupported algorithm")
+	}
+}
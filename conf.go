@@ -17,6 +17,10 @@
 package rattle
 
 import (
+  "crypto/tls"
+  "io"
+  "net"
+  "net/http"
   "time"
 )
 
@@ -31,14 +35,46 @@ type HTTPTimeout struct {
 
 // Config configure
 type Config struct {
-  HTTPTimeout        HTTPTimeout // HTTP的超时时间设置
-  UseProxy           bool        // 是否使用代理
-  ProxyHost          string      // 代理服务器地址
-  IsAuthProxy        bool        // 代理服务器是否使用用户认证
-  ProxyUser          string      // 代理服务器认证用户名
-  ProxyPassword      string      // 代理服务器认证密码
-  ReUseTCP           bool        // 为同一地址多次请求复用TCP连接
-  InsecureSkipVerify bool        // 忽略证书验证
+  HTTPClient            *http.Client                                       // 发送请求使用的http.Client, 设置后不再创建Transport, 超时/代理/TLS等连接设置不生效
+  HTTPTimeout           HTTPTimeout                                        // HTTP的超时时间设置
+  UseProxy              bool                                               // 是否使用代理
+  ProxyHost             string                                             // 代理服务器地址
+  IsAuthProxy           bool                                               // 代理服务器是否使用用户认证
+  ProxyUser             string                                             // 代理服务器认证用户名
+  ProxyPassword         string                                             // 代理服务器认证密码
+  ProxyMaxFailures      int                                                // WithProxyRotation中代理连续失败多少次后不再使用, 0为一直使用
+  ReUseTCP              bool                                               // 为同一地址多次请求复用TCP连接
+  InsecureSkipVerify    bool                                               // 忽略证书验证, 设置TLSConfig时不生效
+  TLSConfig             *tls.Config                                        // 自定义TLS配置, 如CA证书池和客户端证书, nil时使用InsecureSkipVerify和MinTLSVersion
+  DedupeHeaders         bool                                               // 发送前去掉同一请求头中重复的值, 只保留第一个
+  SniffContentType      bool                                               // 未指定Content-Type的原始请求体(Body)根据前512字节检测类型, 见http.DetectContentType
+  FormPreserveOrder     bool                                               // 表单按结构体字段的顺序编码, 为false时按键名排序
+  Decoders              map[string]func(io.Reader, interface{}) error      // 按Content-Type(如"application/yaml")解码响应体, Receive优先使用, 未注册的类型按JSON解码
+  QuerySpaceAsPercent20 bool                                               // 查询参数中的空格编码为"%20", 为false时编码为"+"
+  QueryTimeFormat       string                                             // 查询参数中time.Time的格式, 为"unix"时使用Unix时间戳, 为空时使用RFC3339
+  HostFailureTTL        time.Duration                                      // 连接失败的地址在此时间内的请求直接返回该错误, 由New()创建的子Rattle共享, 0为不缓存
+  RateLimit             float64                                            // 每秒最多发送的请求数(包括重试), 由New()创建的子Rattle共享, 0为不限制
+  RetryTimes            int                                                // 请求失败后的重试次数
+  RetryInterval         time.Duration                                      // 两次重试之间的等待时间, 429/503响应带有Retry-After时以其为准
+  RetryBackoff          float64                                            // 每次重试后等待时间的倍数, 不大于1时等待时间不变
+  RetryMaxInterval      time.Duration                                      // 重试等待时间的上限, 0为不限制
+  RetryJitter           float64                                            // 重试等待时间的随机浮动比例, 如0.2为±20%
+  RetryStatusCodes      []int                                              // 需要重试的HTTP状态码
+  RetryErrorSubstrings  []string                                           // 只重试错误信息包含其中之一的请求错误, 如"connection reset", 为空时重试所有错误
+  RetryDeadline         time.Duration                                      // 所有重试的总时间限制, 超过后不再重试, 0为不限制
+  LingerSeconds         int                                                // TCP连接的SO_LINGER秒数, 0为系统默认, 小于0时关闭连接直接发送RST
+  TCPKeepAlivePeriod    time.Duration                                      // TCP keepalive探测间隔, 0为系统默认
+  TLSHandshakeTimeout   time.Duration                                      // TLS握手超时时间, 超时后会按重试设置重新建立连接
+  MinTLSVersion         uint16                                             // 允许的最低TLS版本, 如tls.VersionTLS12, 0为默认
+  CaptureWire           bool                                               // 记录连接上收发的原始数据, 通过WireLog获取
+  SingleFlight          bool                                               // 合并同时进行的相同GET/HEAD请求(方法+URL相同), 只发送一次
+  SlowRequestThreshold  time.Duration                                      // 慢请求阈值, 0为不检测
+  SlowRequestHandler    func(req *http.Request, dur time.Duration)         // 请求耗时超过阈值时调用
+  MaxConnsPerHost       int                                                // 每个地址的最大连接数(包括空闲和使用中的), 0为不限制
+  Resolver              *net.Resolver                                      // 解析域名使用的DNS解析器, nil为系统默认
+  DisableRedirects      bool                                               // 不跟随重定向, 返回重定向响应本身
+  CheckRedirect         func(req *http.Request, via []*http.Request) error // 重定向策略, 同http.Client.CheckRedirect, nil为默认最多跟随10次
+  CookieJar             http.CookieJar                                     // 保存响应的Cookie并在之后的请求中发送, 由New()创建的子Rattle共享, nil为不处理Cookie
 }
 
 // 获取默认配置
@@ -51,13 +87,104 @@ func NewConfig() *Config {
   config.HTTPTimeout.HeaderTimeout = time.Second * 5  // 5s
   config.HTTPTimeout.MaxTimeout = time.Second * 300   // 300s
 
+  config.HTTPClient = nil
   config.UseProxy = false
   config.ProxyHost = ""
   config.IsAuthProxy = false
   config.ProxyUser = ""
   config.ProxyPassword = ""
+  config.ProxyMaxFailures = 0
   config.ReUseTCP = false
   config.InsecureSkipVerify = true
+  config.TLSConfig = nil
+  config.DedupeHeaders = false
+  config.SniffContentType = false
+  config.FormPreserveOrder = false
+  config.Decoders = nil
+  config.QuerySpaceAsPercent20 = false
+  config.QueryTimeFormat = ""
+  config.HostFailureTTL = 0
+  config.RateLimit = 0
+  config.RetryTimes = 0
+  config.RetryInterval = time.Second // 1s
+  config.RetryBackoff = 0
+  config.RetryMaxInterval = 0
+  config.RetryJitter = 0
+  config.RetryStatusCodes = nil
+  config.RetryErrorSubstrings = nil
+  config.RetryDeadline = 0
+  config.LingerSeconds = 0
+  config.TCPKeepAlivePeriod = 0
+  config.TLSHandshakeTimeout = time.Second * 10 // 10s
+  config.MinTLSVersion = 0
+  config.CaptureWire = false
+  config.SingleFlight = false
+  config.SlowRequestThreshold = 0
+  config.SlowRequestHandler = nil
+  config.MaxConnsPerHost = 0
+  config.Resolver = nil
+  config.DisableRedirects = false
+  config.CheckRedirect = nil
+  config.CookieJar = nil
 
   return config
 }
+
+// Option configures a Rattle created by New. A *Config is an Option too,
+// replacing the whole configuration, so it can be combined with the With*
+// options that follow it.
+type Option interface {
+  apply(config *Config)
+}
+
+func (c *Config) apply(config *Config) {
+  if c != nil {
+    *config = *c
+  }
+}
+
+// optionFunc adapts a function to an Option
+type optionFunc func(config *Config)
+
+func (f optionFunc) apply(config *Config) {
+  f(config)
+}
+
+// WithConnectTimeout sets HTTPTimeout.ConnectTimeout
+func WithConnectTimeout(d time.Duration) Option {
+  return optionFunc(func(config *Config) {
+    config.HTTPTimeout.ConnectTimeout = d
+  })
+}
+
+// WithHeaderTimeout sets HTTPTimeout.HeaderTimeout
+func WithHeaderTimeout(d time.Duration) Option {
+  return optionFunc(func(config *Config) {
+    config.HTTPTimeout.HeaderTimeout = d
+  })
+}
+
+// WithRetries sets RetryTimes
+func WithRetries(n int) Option {
+  return optionFunc(func(config *Config) {
+    config.RetryTimes = n
+  })
+}
+
+// WithCookieJar sets CookieJar
+func WithCookieJar(jar http.CookieJar) Option {
+  return optionFunc(func(config *Config) {
+    config.CookieJar = jar
+  })
+}
+
+// WithRetryBackoff sets RetryInterval, RetryBackoff, RetryMaxInterval and
+// RetryJitter
+func WithRetryBackoff(base time.Duration, multiplier float64, max time.Duration, jitter float64) Option {
+  return optionFunc(func(config *Config) {
+    config.RetryInterval = base
+    config.RetryBackoff = multiplier
+    config.RetryMaxInterval = max
+    config.RetryJitter = jitter
+  })
+}
@@ -18,17 +18,92 @@ package rattle
 
 import (
 	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// lingerConn is implemented by connections supporting SO_LINGER, e.g. *net.TCPConn
+type lingerConn interface {
+	SetLinger(sec int) error
+}
+
+// keepAliveConn is implemented by connections supporting TCP keepalive, e.g. *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// tuneConn applies the socket options of config to a freshly dialed connection.
+// Options the connection doesn't support are skipped.
+func tuneConn(conn net.Conn, config *Config) error {
+	if config.LingerSeconds != 0 {
+		if c, ok := conn.(lingerConn); ok {
+			sec := config.LingerSeconds
+			if sec < 0 {
+				sec = 0
+			}
+			if err := c.SetLinger(sec); err != nil {
+				return err
+			}
+		}
+	}
+	if config.TCPKeepAlivePeriod > 0 {
+		if c, ok := conn.(keepAliveConn); ok {
+			if err := c.SetKeepAlive(true); err != nil {
+				return err
+			}
+			if err := c.SetKeepAlivePeriod(config.TCPKeepAlivePeriod); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // Handle http timeout
 type timeoutConn struct {
 	conn    net.Conn
 	timeout HTTPTimeout
+
+	mu        sync.Mutex
+	deadline  time.Time     // absolute deadline capping the timeouts, zero for none
+	ioTimeout time.Duration // replaces ReadTimeout and WriteTimeout if > 0
+	wire      *wireLog      // records the bytes of the current request, nil for none
+
+	// owner is the request the settings above belong to, see claim
+	ownerMu sync.Mutex
+	owner   interface{}
+
+	closeOnce sync.Once
+	onClose   func() // called once the connection is closed, may be nil
+}
+
+// wireLog records the raw bytes sent and received on connections.
+type wireLog struct {
+	mu       sync.Mutex
+	sent     []byte
+	received []byte
+}
+
+func (l *wireLog) recordSent(b []byte) {
+	l.mu.Lock()
+	l.sent = append(l.sent, b...)
+	l.mu.Unlock()
+}
+
+func (l *wireLog) recordReceived(b []byte) {
+	l.mu.Lock()
+	l.received = append(l.received, b...)
+	l.mu.Unlock()
 }
 
 func newTimeoutConn(conn net.Conn, timeout HTTPTimeout) *timeoutConn {
-	_ = conn.SetDeadline(time.Now().Add(timeout.MaxTimeout))
+	if timeout.MaxTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout.MaxTimeout))
+	}
 	return &timeoutConn{
 		conn:    conn,
 		timeout: timeout,
@@ -36,28 +111,248 @@ func newTimeoutConn(conn net.Conn, timeout HTTPTimeout) *timeoutConn {
 }
 
 func (c *timeoutConn) Read(b []byte) (n int, err error) {
-	if c.timeout.ReadTimeout > 0 {
-		_ = c.SetReadDeadline(time.Now().Add(c.timeout.ReadTimeout))
+	if timeout := c.ioTimeoutOr(c.timeout.ReadTimeout); timeout > 0 {
+		_ = c.SetReadDeadline(c.capDeadline(time.Now().Add(timeout)))
 	}
 	n, err = c.conn.Read(b)
+	if w := c.wireLog(); w != nil && n > 0 {
+		w.recordReceived(b[:n])
+	}
 	if c.timeout.MaxTimeout > 0 {
-		_ = c.SetReadDeadline(time.Now().Add(c.timeout.MaxTimeout))
+		_ = c.SetReadDeadline(c.capDeadline(time.Now().Add(c.timeout.MaxTimeout)))
 	}
 	return n, err
 }
 
 func (c *timeoutConn) Write(b []byte) (n int, err error) {
-	if c.timeout.WriteTimeout > 0 {
-		_ = c.SetWriteDeadline(time.Now().Add(c.timeout.WriteTimeout))
+	if timeout := c.ioTimeoutOr(c.timeout.WriteTimeout); timeout > 0 {
+		_ = c.SetWriteDeadline(c.capDeadline(time.Now().Add(timeout)))
 	}
 	n, err = c.conn.Write(b)
+	if w := c.wireLog(); w != nil && n > 0 {
+		w.recordSent(b[:n])
+	}
 	if c.timeout.MaxTimeout > 0 {
-		_ = c.SetWriteDeadline(time.Now().Add(c.timeout.MaxTimeout))
+		_ = c.SetWriteDeadline(c.capDeadline(time.Now().Add(c.timeout.MaxTimeout)))
 	}
 	return n, err
 }
 
+// capDeadline returns t, or the absolute deadline if that comes first. A
+// zero t is no deadline.
+func (c *timeoutConn) capDeadline(t time.Time) time.Time {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && (t.IsZero() || deadline.Before(t)) {
+		return deadline
+	}
+	return t
+}
+
+// setAbsDeadline sets an absolute deadline that no read or write on the
+// connection may pass. A zero t removes it again.
+func (c *timeoutConn) setAbsDeadline(t time.Time) {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	if t.IsZero() && c.timeout.MaxTimeout > 0 {
+		t = time.Now().Add(c.timeout.MaxTimeout)
+	}
+	_ = c.conn.SetDeadline(t)
+}
+
+// ioTimeoutOr returns the read/write timeout set by setIOTimeout, or
+// timeout if none is set.
+func (c *timeoutConn) ioTimeoutOr(timeout time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ioTimeout > 0 {
+		return c.ioTimeout
+	}
+	return timeout
+}
+
+// setIOTimeout replaces the read and write timeouts of the connection by d.
+// A zero d restores them.
+func (c *timeoutConn) setIOTimeout(d time.Duration) {
+	c.mu.Lock()
+	c.ioTimeout = d
+	c.mu.Unlock()
+	// the transport may be blocked reading already, waiting for the response,
+	// or for the next one with the deadline of the last request
+	var deadline time.Time
+	if timeout := c.ioTimeoutOr(c.timeout.ReadTimeout); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	} else if c.timeout.MaxTimeout > 0 {
+		deadline = time.Now().Add(c.timeout.MaxTimeout)
+	}
+	_ = c.SetReadDeadline(c.capDeadline(deadline))
+}
+
+func (c *timeoutConn) wireLog() *wireLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wire
+}
+
+func (c *timeoutConn) setWireLog(w *wireLog) {
+	c.mu.Lock()
+	c.wire = w
+	c.mu.Unlock()
+}
+
+// claim makes owner the request using the connection, replacing the
+// settings of the one before: the absolute deadline, the read/write timeout
+// of setIOTimeout and the wire log. Zero values set none.
+func (c *timeoutConn) claim(owner interface{}, deadline time.Time, ioTimeout time.Duration, wire *wireLog) {
+	c.ownerMu.Lock()
+	defer c.ownerMu.Unlock()
+	c.owner = owner
+	c.setAbsDeadline(deadline)
+	c.setIOTimeout(ioTimeout)
+	c.setWireLog(wire)
+}
+
+// release removes the settings of owner, unless the connection went back to
+// the pool and has been claimed by another request since.
+func (c *timeoutConn) release(owner interface{}) {
+	c.ownerMu.Lock()
+	defer c.ownerMu.Unlock()
+	if c.owner != owner {
+		return
+	}
+	c.owner = nil
+	c.setAbsDeadline(time.Time{})
+	c.setIOTimeout(0)
+	c.setWireLog(nil)
+}
+
+// hookConns applies the per-request connection settings of r, the socket
+// deadline, the timeout of SetDynamicTimeout and the wire capture, to every
+// connection req gets, replacing those of the request before on it. The
+// returned func detaches them again once the response has been read, unless
+// the connection already serves another request.
+func (r *Rattle) hookConns(req *http.Request) (*http.Request, func()) {
+	var deadline time.Time
+	if r.socketDeadline > 0 {
+		deadline = time.Now().Add(r.socketDeadline)
+	}
+	r.wire = nil
+	if r.config.CaptureWire {
+		r.wire = &wireLog{}
+	}
+	var (
+		mu    sync.Mutex
+		conns []*timeoutConn
+		// identifies the request to the connections, see claim
+		owner = new(int)
+	)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := findTimeoutConn(info.Conn)
+			if conn == nil {
+				return
+			}
+			var ioTimeout time.Duration
+			if r.dynamicTimeout != nil {
+				// connections are got on the goroutine sending, between retries
+				ioTimeout = r.dynamicTimeout(r.stats.Retries)
+			}
+			// requests without settings claim too, clearing those of the last
+			conn.claim(owner, deadline, ioTimeout, r.wire)
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		},
+	}))
+	return req, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.release(owner)
+		}
+	}
+}
+
+// transportCache holds the transports derived from the one of a client,
+// shared by its rattles so that they share the connection pools as well.
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+// transportKey identifies a transport derived from base by name.
+type transportKey struct {
+	base *http.Transport
+	name string
+}
+
+// derive returns the clone of base changed by configure, made on the first
+// call for base and name and reused on the later ones.
+func (c *transportCache) derive(base *http.Transport, name string, configure func(transport *http.Transport)) *http.Transport {
+	if c == nil {
+		transport := base.Clone()
+		configure(transport)
+		return transport
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := transportKey{base: base, name: name}
+	if transport, ok := c.transports[key]; ok {
+		return transport
+	}
+	transport := base.Clone()
+	configure(transport)
+	if c.transports == nil {
+		c.transports = make(map[transportKey]*http.Transport)
+	}
+	c.transports[key] = transport
+	return transport
+}
+
+// OpenConnections returns the number of connections, idle or in use, the
+// client of r currently holds open. Rattles created by New share it.
+func (r *Rattle) OpenConnections() int {
+	if r.openConns == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(r.openConns))
+}
+
+// WireLog returns the raw bytes sent and received for the last request when
+// Config.CaptureWire is set. For HTTPS these are the encrypted TLS records.
+func (r *Rattle) WireLog() (sent, received []byte) {
+	if r.wire == nil {
+		return nil, nil
+	}
+	r.wire.mu.Lock()
+	defer r.wire.mu.Unlock()
+	return append([]byte{}, r.wire.sent...), append([]byte{}, r.wire.received...)
+}
+
+// findTimeoutConn returns the timeoutConn underlying conn, unwrapping TLS
+// connections, or nil if conn wasn't dialed by Rattle.
+func findTimeoutConn(conn net.Conn) *timeoutConn {
+	for conn != nil {
+		if c, ok := conn.(*timeoutConn); ok {
+			return c
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
 func (c *timeoutConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
 	return c.conn.Close()
 }
 
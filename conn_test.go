@@ -0,0 +1,350 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// optionConn records the socket options applied to it.
+type optionConn struct {
+	net.Conn
+	linger          int
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+}
+
+func (c *optionConn) SetLinger(sec int) error {
+	c.linger = sec
+	return nil
+}
+
+func (c *optionConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *optionConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+func TestTuneConn_linger(t *testing.T) {
+	cases := []struct {
+		lingerSeconds int
+		expected      int
+	}{
+		{0, -1},
+		{5, 5},
+		{-1, 0},
+	}
+	for _, c := range cases {
+		config := NewConfig()
+		config.LingerSeconds = c.lingerSeconds
+		conn := &optionConn{linger: -1}
+		if err := tuneConn(conn, config); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if conn.linger != c.expected {
+			t.Errorf("expected linger %d for LingerSeconds %d, got %d", c.expected, c.lingerSeconds, conn.linger)
+		}
+	}
+}
+
+func TestTuneConn_keepAlive(t *testing.T) {
+	config := NewConfig()
+	conn := &optionConn{}
+	if err := tuneConn(conn, config); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if conn.keepAlive || conn.keepAlivePeriod != 0 {
+		t.Errorf("expected keepalive untouched by default, got %v %v", conn.keepAlive, conn.keepAlivePeriod)
+	}
+
+	config.TCPKeepAlivePeriod = 15 * time.Second
+	if err := tuneConn(conn, config); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !conn.keepAlive {
+		t.Errorf("expected keepalive to be enabled")
+	}
+	if conn.keepAlivePeriod != config.TCPKeepAlivePeriod {
+		t.Errorf("expected keepalive period %v, got %v", config.TCPKeepAlivePeriod, conn.keepAlivePeriod)
+	}
+}
+
+func TestWithSocketDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 10; i++ {
+			_, _ = w.Write([]byte("tick\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	_, _, err := New().Get(ts.URL).WithSocketDeadline(100 * time.Millisecond).Send()
+	if err == nil {
+		t.Fatalf("expected the socket deadline to abort the request")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected abort after about 100ms, took %v", elapsed)
+	}
+
+	result, _, err := New().Get(ts.URL).Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(result) != 50 {
+		t.Errorf("expected 50 bytes without deadline, got %d", len(result))
+	}
+}
+
+func TestWithSocketDeadline_reusedConn(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	config.HTTPTimeout.ReadTimeout = 0
+	config.HTTPTimeout.MaxTimeout = 0
+	client := New(config).BaseURL(ts.URL)
+
+	// the connection goes back to the pool once the body is read, before
+	// it's closed, so the next request gets it while the first isn't done
+	first, _, err := client.New().Get("/fast").WithSocketDeadline(100 * time.Millisecond).SendStream()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, _ = ioutil.ReadAll(first)
+	result, _, err := client.New().Post("/slow").Send()
+	if err != nil || string(result) != "done" {
+		t.Errorf("expected the slow response without the deadline of the first, got %q %v", result, err)
+	}
+	_ = first.Close()
+
+	// nor does the first take the deadline of the next one away
+	first, _, err = client.New().Get("/fast").WithSocketDeadline(time.Minute).SendStream()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, _ = ioutil.ReadAll(first)
+	next, _, err := client.New().Post("/slow").WithSocketDeadline(100 * time.Millisecond).SendStream()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_ = first.Close()
+	if _, err = ioutil.ReadAll(next); err == nil {
+		t.Errorf("expected the socket deadline to abort the slow body")
+	}
+	_ = next.Close()
+
+	if stats := client.PoolStats(); stats.ConnectionsReused != 3 || stats.ConnectionsCreated != 1 {
+		t.Errorf("expected the connection reused, got %+v", stats)
+	}
+}
+
+func TestWireLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Wire", "yes")
+		_, _ = w.Write([]byte("wire body"))
+	}))
+	defer ts.Close()
+
+	rattle := New().Get(ts.URL+"/captured").SetHeader("X-Test", "1")
+	_, _, _ = rattle.Send()
+	if sent, received := rattle.WireLog(); sent != nil || received != nil {
+		t.Errorf("expected nothing captured by default")
+	}
+
+	config := NewConfig()
+	config.CaptureWire = true
+	rattle = New(config).Get(ts.URL+"/captured").SetHeader("X-Test", "1")
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	sent, received := rattle.WireLog()
+	for _, expected := range []string{"GET /captured HTTP/1.1\r\n", "X-Test: 1\r\n"} {
+		if !strings.Contains(string(sent), expected) {
+			t.Errorf("expected sent bytes to contain %q, got %q", expected, sent)
+		}
+	}
+	for _, expected := range []string{"HTTP/1.1 200 OK\r\n", "X-Wire: yes\r\n", "wire body"} {
+		if !strings.Contains(string(received), expected) {
+			t.Errorf("expected received bytes to contain %q, got %q", expected, received)
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestOpenConnections(t *testing.T) {
+	const concurrency = 3
+	arrived := make(chan struct{}, concurrency)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+
+	rattle := New()
+	if n := rattle.OpenConnections(); n != 0 {
+		t.Errorf("expected no connections yet, got %d", n)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = rattle.New().Get(ts.URL).Send()
+		}()
+	}
+	for i := 0; i < concurrency; i++ {
+		<-arrived
+	}
+	if n := rattle.OpenConnections(); n != concurrency {
+		t.Errorf("expected %d open connections, got %d", concurrency, n)
+	}
+	close(release)
+	wg.Wait()
+	if !waitFor(func() bool { return rattle.OpenConnections() == 0 }) {
+		t.Errorf("expected the connections closed, got %d", rattle.OpenConnections())
+	}
+}
+
+func TestConfig_maxConnsPerHost(t *testing.T) {
+	var active, peak int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	config.MaxConnsPerHost = 1
+	rattle := New(config)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = rattle.New().Get(ts.URL).Send()
+		}()
+	}
+	wg.Wait()
+	if p := atomic.LoadInt32(&peak); p != 1 {
+		t.Errorf("expected at most 1 concurrent request, got %d", p)
+	}
+	if n := rattle.OpenConnections(); n > 1 {
+		t.Errorf("expected at most 1 open connection, got %d", n)
+	}
+}
+
+func TestSetDynamicTimeout(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryInterval = time.Millisecond
+	expected := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond}
+	var timeouts []time.Duration
+	grow := func(attempt int) time.Duration {
+		timeouts = append(timeouts, expected[attempt])
+		return expected[attempt]
+	}
+	result, _, err := New(config).Get(ts.URL).SetDynamicTimeout(grow).Send()
+	if err != nil || string(result) != "slow" {
+		t.Fatalf("expected the last attempt to wait long enough, got %q %v", result, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	if !reflect.DeepEqual(expected, timeouts) {
+		t.Errorf("expected timeouts growing as %v, got %v", expected, timeouts)
+	}
+}
+
+func TestSetDynamicTimeout_reusedConn(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	config.HTTPTimeout.ReadTimeout = 0
+	config.HTTPTimeout.MaxTimeout = 0
+	client := New(config).BaseURL(ts.URL)
+	fixed := func(int) time.Duration { return 50 * time.Millisecond }
+	if _, _, err := client.New().Get("/fast").SetDynamicTimeout(fixed).Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the connection is reused without the timeout of the last request, POST
+	// so the transport doesn't hide a failure by sending again
+	result, _, err := client.New().Post("/slow").Send()
+	if err != nil || string(result) != "done" {
+		t.Errorf("expected the slow response without timeout, got %q %v", result, err)
+	}
+	if stats := client.PoolStats(); stats.ConnectionsReused != 1 || stats.ConnectionsCreated != 1 {
+		t.Errorf("expected the connection reused, got %+v", stats)
+	}
+}
@@ -25,7 +25,11 @@ const (
 	DELETE  = "DELETE"
 	OPTIONS = "OPTIONS"
 
-	contentTypeJson = "application/json"
-	contentType     = "Content-Type"
-	contentTypeForm = "application/x-www-form-urlencoded"
-)
\ No newline at end of file
+	contentTypeJson     = "application/json"
+	contentTypeXml      = "application/xml"
+	contentType         = "Content-Type"
+	contentTypeForm     = "application/x-www-form-urlencoded"
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeMsgPack  = "application/msgpack"
+	contentEncoding     = "Content-Encoding"
+)
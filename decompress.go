@@ -0,0 +1,100 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decompressResponse replaces a gzip or deflate encoded body of resp with
+// its decompressed content and strips Content-Encoding, so callers don't
+// decode it twice. Stacked encodings, e.g. "deflate, gzip", are decoded in
+// reverse order. Bodies with any other encoding are left as they are. The
+// transport only does this itself for the gzip it asked for, not when
+// Accept-Encoding was set by the caller.
+func decompressResponse(resp *http.Response) error {
+	var codings []string
+	for _, coding := range strings.Split(resp.Header.Get(contentEncoding), ",") {
+		switch coding = strings.ToLower(strings.TrimSpace(coding)); coding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate":
+			codings = append(codings, coding)
+		default:
+			return nil
+		}
+	}
+	if len(codings) == 0 {
+		return nil
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		var decoder io.ReadCloser
+		var err error
+		if codings[i] == "deflate" {
+			decoder, err = newDeflateReader(resp.Body)
+		} else {
+			decoder, err = gzip.NewReader(resp.Body)
+		}
+		if err == io.EOF {
+			// empty body, e.g. of HEAD requests or 204 responses
+			break
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body = &decodedBody{Reader: decoder, decoder: decoder, body: resp.Body}
+	}
+	resp.Header.Del(contentEncoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// newDeflateReader reads deflate bodies, which should be zlib wrapped but
+// are raw deflate data from some servers.
+func newDeflateReader(body io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(body)
+	header, err := buffered.Peek(2)
+	if len(header) == 0 {
+		return nil, err
+	}
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// decodedBody reads through decoder, closing it and the original body.
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	err := d.decoder.Close()
+	if bodyErr := d.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
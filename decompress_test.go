@@ -0,0 +1,125 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecompressResponse(t *testing.T) {
+	payload := []byte(`{"id":1,"name":"rattle"}`)
+	encoders := map[string]func(w io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+	for name, encoder := range encoders {
+		buf := &bytes.Buffer{}
+		writer := encoder(buf)
+		_, _ = writer.Write(payload)
+		_ = writer.Close()
+		encoding := name
+		if name == "raw deflate" {
+			encoding = "deflate"
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", encoding)
+			_, _ = w.Write(buf.Bytes())
+		}))
+
+		// asking for the encoding disables the decompression of the transport
+		rattle := New().Get(ts.URL).SetHeader("Accept-Encoding", encoding)
+		result, _, err := rattle.Send()
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !bytes.Equal(result, payload) {
+			t.Errorf("%s: expected %s, got %q", name, payload, result)
+		}
+		if got := rattle.GetResponse().Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected Content-Encoding stripped, got %q", name, got)
+		}
+	}
+
+	// empty encoded bodies aren't an error
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	if _, code, err := New().Get(ts.URL).SetHeader("Accept-Encoding", "gzip").Send(); err != nil || code != http.StatusNoContent {
+		t.Errorf("expected an empty 204, got %d %v", code, err)
+	}
+}
+
+func TestDecompressResponse_stacked(t *testing.T) {
+	payload := []byte(`{"id":1,"name":"rattle"}`)
+	// deflate applied first, then gzip
+	deflated := &bytes.Buffer{}
+	zw := zlib.NewWriter(deflated)
+	_, _ = zw.Write(payload)
+	_ = zw.Close()
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	_, _ = gw.Write(deflated.Bytes())
+	_ = gw.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/br" {
+			w.Header().Set("Content-Encoding", "gzip, br")
+			_, _ = w.Write([]byte("brotli"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "deflate, gzip")
+		_, _ = w.Write(gzipped.Bytes())
+	}))
+	defer ts.Close()
+
+	rattle := New().Get(ts.URL).SetHeader("Accept-Encoding", "gzip, deflate")
+	result, _, err := rattle.Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !bytes.Equal(result, payload) {
+		t.Errorf("expected %s, got %q", payload, result)
+	}
+	if got := rattle.GetResponse().Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("expected Content-Encoding stripped, got %q", got)
+	}
+
+	// encodings that can't be decoded are left to the caller
+	rattle = New().Get(ts.URL+"/br").SetHeader("Accept-Encoding", "gzip, br")
+	if result, _, err = rattle.Send(); err != nil || string(result) != "brotli" {
+		t.Errorf("expected the body as it is, got %q %v", result, err)
+	}
+	if got := rattle.GetResponse().Header.Get("Content-Encoding"); got != "gzip, br" {
+		t.Errorf("expected Content-Encoding kept, got %q", got)
+	}
+}
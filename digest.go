@@ -0,0 +1,178 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// digestAuth holds the credentials for HTTP Digest Authentication
+type digestAuth struct {
+	username string
+	password string
+}
+
+// SetDigestAuth enables HTTP Digest Authentication. When a request is
+// answered with a 401 Digest challenge, it is sent once more with the
+// computed Authorization header. MD5 and SHA-256 with qop "auth" are supported.
+func (r *Rattle) SetDigestAuth(username, password string) *Rattle {
+	r.digest = &digestAuth{username: username, password: password}
+	return r
+}
+
+// retry answers the Digest challenge of resp by sending req once more with
+// the Authorization header through send. Other responses are returned
+// unchanged.
+func (d *digestAuth) retry(send func(*http.Request) (*http.Response, error), req *http.Request, resp *http.Response) (*http.Response, error) {
+	challenge := digestChallenge(resp)
+	if challenge == nil || !resetBody(req) {
+		return resp, nil
+	}
+	discardResponse(resp)
+	auth, err := d.authorization(req, challenge)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", auth)
+	return send(req)
+}
+
+// digestChallenge returns the parameters of the Digest challenge of a 401
+// response, or nil if there is none.
+func digestChallenge(resp *http.Response) map[string]string {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		if len(value) > 7 && strings.EqualFold(value[:7], "Digest ") {
+			return parseAuthParams(value[7:])
+		}
+	}
+	return nil
+}
+
+// parseAuthParams parses the comma separated key=value pairs of a challenge.
+// Values may be quoted and contain commas.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// authorization returns the Authorization header answering the challenge for req.
+func (d *digestAuth) authorization(req *http.Request, challenge map[string]string) (string, error) {
+	algorithm := challenge["algorithm"]
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("digest algorithm %s not supported", algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		_, _ = sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	qop := ""
+	if challenge["qop"] != "" {
+		for _, q := range strings.Split(challenge["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("digest qop %s not supported", challenge["qop"])
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	nc := "00000001"
+	nonce := challenge["nonce"]
+	uri := req.URL.RequestURI()
+
+	ha1 := h(d.username + ":" + challenge["realm"] + ":" + d.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+	var response string
+	if qop == "" {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q`,
+		d.username, challenge["realm"], nonce, uri, response)
+	if algorithm != "" {
+		auth += ", algorithm=" + algorithm
+	}
+	if qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce=%q`, qop, nc, cnonce)
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque=%q`, opaque)
+	}
+	return auth, nil
+}
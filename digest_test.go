@@ -0,0 +1,82 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSetDigestAuth(t *testing.T) {
+	const realm, nonce, opaque = "rattle@example.com", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "5ccc069c403ebaf9f0171e9517f40e41"
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(req.Body)
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Digest ") {
+			w.Header().Set("WWW-Authenticate", `Digest realm="`+realm+`", qop="auth,auth-int", nonce="`+nonce+`", opaque="`+opaque+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p := parseAuthParams(auth[len("Digest "):])
+		ha1 := md5Hex("user:" + realm + ":secret")
+		ha2 := md5Hex(req.Method + ":" + req.URL.RequestURI())
+		expected := md5Hex(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+		if p["username"] != "user" || p["uri"] != req.URL.RequestURI() || p["opaque"] != opaque || p["response"] != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(append([]byte("welcome "), body...))
+	}))
+	defer ts.Close()
+
+	result, code, err := New().Post(ts.URL+"/private?x=1").SetDigestAuth("user", "secret").BodyOriginal(strings.NewReader("body")).Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK || string(result) != "welcome body" {
+		t.Errorf("expected 200 welcome body, got %d %s", code, result)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+
+	_, code, _ = New().Get(ts.URL).SetDigestAuth("user", "wrong").Send()
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for wrong password, got %d", code)
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	p := parseAuthParams(`realm="a, b", qop="auth,auth-int", nonce=abc, stale=FALSE, opaque="q\"x"`)
+	expected := map[string]string{"realm": "a, b", "qop": "auth,auth-int", "nonce": "abc", "stale": "FALSE", "opaque": `q"x`}
+	if !reflect.DeepEqual(expected, p) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, p)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const acceptLanguage = "Accept-Language"
+
+// HeaderProfile is a set of browser headers that belong together and are
+// always sent together. Empty fields are left untouched.
+type HeaderProfile struct {
+	UserAgent      string
+	Accept         string
+	AcceptLanguage string
+	// client hints such as Sec-CH-UA, Sec-CH-UA-Mobile and Sec-CH-UA-Platform
+	ClientHints map[string]string
+}
+
+// apply sets the profile headers on req that aren't in explicit, the
+// headers set by the caller.
+func (p HeaderProfile) apply(req *http.Request, explicit http.Header) {
+	set := func(key, value string) {
+		if value != "" && len(explicit.Values(key)) == 0 {
+			req.Header.Set(key, value)
+		}
+	}
+	set("User-Agent", p.UserAgent)
+	set("Accept", p.Accept)
+	set(acceptLanguage, p.AcceptLanguage)
+	for key, value := range p.ClientHints {
+		set(key, value)
+	}
+}
+
+// AcceptLanguage sets the Accept-Language header to the given languages in
+// order of preference, e.g. AcceptLanguage("en-US", "en;q=0.8").
+func (r *Rattle) AcceptLanguage(langs ...string) *Rattle {
+	r.acceptLanguages = nil
+	if len(langs) == 0 {
+		r.header.Del(acceptLanguage)
+		return r
+	}
+	return r.SetHeader(acceptLanguage, strings.Join(langs, ", "))
+}
+
+// ForwardedFor sets the X-Forwarded-For header to the chain of ips, client
+// first. An ip that can't be parsed is recorded as error, see Err.
+func (r *Rattle) ForwardedFor(ips ...string) *Rattle {
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return r.setErr(fmt.Errorf("ForwardedFor: invalid IP %q", ip))
+		}
+	}
+	if len(ips) == 0 {
+		r.header.Del("X-Forwarded-For")
+		return r
+	}
+	return r.SetHeader("X-Forwarded-For", strings.Join(ips, ", "))
+}
+
+// AcceptFallback sets the Accept header to the first of types. When the
+// server answers 406 Not Acceptable, the request is sent again with the next
+// type, until one is accepted or all types are exhausted.
+func (r *Rattle) AcceptFallback(types ...string) *Rattle {
+	r.acceptTypes = append([]string{}, types...)
+	return r
+}
+
+// negotiate sends req with the next Accept fallback type as long as resp
+// is 406 Not Acceptable.
+func (r *Rattle) negotiate(req *http.Request, resp *http.Response) (*http.Response, error) {
+	for i := 1; i < len(r.acceptTypes) && resp.StatusCode == http.StatusNotAcceptable; i++ {
+		if !resetBody(req) {
+			break
+		}
+		discardResponse(resp)
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept", r.acceptTypes[i])
+		var err error
+		if resp, err = r.attempt(req); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// RotateAcceptLanguage cycles the Accept-Language header through langs,
+// using the next one for each generated request.
+func (r *Rattle) RotateAcceptLanguage(langs ...string) *Rattle {
+	r.acceptLanguages = append([]string{}, langs...)
+	r.acceptLanguageNext = 0
+	return r
+}
+
+// RandomizeFingerprint picks one of profiles at random for each generated
+// request and sets all of its headers, so they never mix across profiles.
+// Headers set with SetHeader or AddHeader are kept.
+func (r *Rattle) RandomizeFingerprint(profiles []HeaderProfile) *Rattle {
+	r.fingerprints = append([]HeaderProfile{}, profiles...)
+	return r
+}
+
+// rotateHeaders sets the rotating headers of the next request.
+func (r *Rattle) rotateHeaders(req *http.Request) {
+	if len(r.acceptTypes) > 0 {
+		req.Header.Set("Accept", r.acceptTypes[0])
+	}
+	if n := len(r.fingerprints); n > 0 {
+		r.fingerprints[rand.Intn(n)].apply(req, r.header)
+	}
+	if n := len(r.acceptLanguages); n > 0 {
+		i := atomic.AddUint32(&r.acceptLanguageNext, 1) - 1
+		req.Header.Set(acceptLanguage, r.acceptLanguages[int(i%uint32(n))])
+	}
+}
+
+// dedupeHeaders removes the repeated values of each header, keeping the
+// first of them, see Config.DedupeHeaders.
+func dedupeHeaders(header http.Header) {
+	for key, values := range header {
+		if len(values) < 2 {
+			continue
+		}
+		seen := make(map[string]bool, len(values))
+		unique := values[:0:0]
+		for _, value := range values {
+			if !seen[value] {
+				seen[value] = true
+				unique = append(unique, value)
+			}
+		}
+		header[key] = unique
+	}
+}
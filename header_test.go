@@ -0,0 +1,198 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAcceptLanguage(t *testing.T) {
+	req, _ := New().AcceptLanguage("en-US", "en;q=0.8").GetRequest()
+	if got := req.Header.Get(acceptLanguage); got != "en-US, en;q=0.8" {
+		t.Errorf("expected Accept-Language en-US, en;q=0.8, got %s", got)
+	}
+}
+
+func TestRotateAcceptLanguage(t *testing.T) {
+	rattle := New().Get("http://example.com").RotateAcceptLanguage("en-US", "de-DE", "zh-CN")
+	expected := []string{"en-US", "de-DE", "zh-CN", "en-US"}
+	for i, lang := range expected {
+		req, err := rattle.GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if got := req.Header.Get(acceptLanguage); got != lang {
+			t.Errorf("request %d: expected Accept-Language %s, got %s", i, lang, got)
+		}
+	}
+
+	// a fixed language replaces the rotation
+	req, _ := rattle.AcceptLanguage("fr-FR").GetRequest()
+	if got := req.Header.Get(acceptLanguage); got != "fr-FR" {
+		t.Errorf("expected Accept-Language fr-FR, got %s", got)
+	}
+}
+
+func TestRandomizeFingerprint(t *testing.T) {
+	profiles := []HeaderProfile{
+		{
+			UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0",
+			Accept:         "text/html,application/xhtml+xml",
+			AcceptLanguage: "en-US,en;q=0.9",
+			ClientHints:    map[string]string{"Sec-CH-UA-Platform": `"Windows"`, "Sec-CH-UA-Mobile": "?0"},
+		},
+		{
+			UserAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Safari/605.1.15",
+			Accept:         "text/html",
+			AcceptLanguage: "de-DE,de;q=0.9",
+			ClientHints:    map[string]string{"Sec-CH-UA-Platform": `"macOS"`, "Sec-CH-UA-Mobile": "?0"},
+		},
+	}
+	rattle := New().Get("http://example.com").RandomizeFingerprint(profiles)
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		req, err := rattle.GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var profile *HeaderProfile
+		for j := range profiles {
+			if profiles[j].UserAgent == req.Header.Get("User-Agent") {
+				profile = &profiles[j]
+			}
+		}
+		if profile == nil {
+			t.Fatalf("User-Agent %s not from any profile", req.Header.Get("User-Agent"))
+		}
+		seen[profile.UserAgent] = true
+		if req.Header.Get("Accept") != profile.Accept || req.Header.Get(acceptLanguage) != profile.AcceptLanguage {
+			t.Errorf("headers mixed across profiles: %v", req.Header)
+		}
+		for key, value := range profile.ClientHints {
+			if req.Header.Get(key) != value {
+				t.Errorf("expected %s %s, got %s", key, value, req.Header.Get(key))
+			}
+		}
+	}
+	if len(seen) != len(profiles) {
+		t.Errorf("expected all %d profiles to be used, got %d", len(profiles), len(seen))
+	}
+
+	rattle = New().Get("http://example.com").SetHeader("User-Agent", "rattle-test").
+		SetHeader("Sec-CH-UA-Platform", `"Linux"`).RandomizeFingerprint(profiles)
+	for i := 0; i < 10; i++ {
+		req, err := rattle.GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if ua, platform := req.Header.Get("User-Agent"), req.Header.Get("Sec-CH-UA-Platform"); ua != "rattle-test" || platform != `"Linux"` {
+			t.Errorf("expected the explicit headers kept, got %q %q", ua, platform)
+		}
+		if req.Header.Get("Accept") == "" || req.Header.Get("Sec-CH-UA-Mobile") != "?0" {
+			t.Errorf("expected the other profile headers filled in, got %v", req.Header)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	rattle := New().ForwardedFor("203.0.113.7", "10.0.0.1", "2001:db8::1")
+	if err := rattle.Err(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	req, _ := rattle.GetRequest()
+	if got := req.Header.Get("X-Forwarded-For"); got != "203.0.113.7, 10.0.0.1, 2001:db8::1" {
+		t.Errorf("expected joined X-Forwarded-For, got %s", got)
+	}
+
+	rattle = New().ForwardedFor("203.0.113.7", "not-an-ip")
+	if rattle.Err() == nil {
+		t.Errorf("expected error for invalid IP")
+	}
+	if _, err := rattle.GetRequest(); err != rattle.Err() {
+		t.Errorf("expected GetRequest to return %v, got %v", rattle.Err(), err)
+	}
+	if _, _, err := rattle.New().Send(); err == nil {
+		t.Errorf("expected child rattle to keep the error")
+	}
+}
+
+func TestAcceptFallback(t *testing.T) {
+	var accepts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		accepts = append(accepts, req.Header.Get("Accept"))
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("Accept") != "application/xml" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set(contentType, "application/xml")
+		_, _ = w.Write([]byte("<item>" + string(body) + "</item>"))
+	}))
+	defer ts.Close()
+
+	rattle := New().Post(ts.URL).BodyOriginal(strings.NewReader("a")).AcceptFallback("application/json", "application/xml", "text/plain")
+	result, code, err := rattle.Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK || string(result) != "<item>a</item>" {
+		t.Errorf("expected the XML response, got %d %s", code, result)
+	}
+	expected := []string{"application/json", "application/xml"}
+	if !reflect.DeepEqual(expected, accepts) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, accepts)
+	}
+
+	_, code, _ = New().Get(ts.URL).AcceptFallback("application/json", "text/plain").Send()
+	if code != http.StatusNotAcceptable {
+		t.Errorf("expected 406 once all types are exhausted, got %d", code)
+	}
+}
+
+func TestConfig_dedupeHeaders(t *testing.T) {
+	build := func(config *Config) *http.Request {
+		req, err := New(config).Get("http://example.com").
+			AddHeader("X-Tag", "a").
+			AddHeader("X-Tag", "b").
+			AddHeader("X-Tag", "a").
+			AddHeader("Cache-Control", "no-cache").
+			GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return req
+	}
+
+	if got := build(NewConfig()).Header["X-Tag"]; !reflect.DeepEqual([]string{"a", "b", "a"}, got) {
+		t.Errorf("expected duplicates kept by default, got %v", got)
+	}
+
+	config := NewConfig()
+	config.DedupeHeaders = true
+	req := build(config)
+	if got := req.Header["X-Tag"]; !reflect.DeepEqual([]string{"a", "b"}, got) {
+		t.Errorf("expected [a b], got %v", got)
+	}
+	if got := req.Header["Cache-Control"]; !reflect.DeepEqual([]string{"no-cache"}, got) {
+		t.Errorf("expected [no-cache], got %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HistoryEntry summarizes a call of Do, see WithHistory.
+type HistoryEntry struct {
+	Method string
+	URL    string
+	// status code of the response, 0 if none arrived
+	Code     int
+	Duration time.Duration
+	Err      error
+}
+
+// history keeps the last entries of a ring buffer.
+type history struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	// index of the next entry written
+	next int
+	full bool
+}
+
+// WithHistory keeps a summary of the last n calls of Do, read by History.
+// Rattles created by New share it. n <= 0 stops keeping history.
+func (r *Rattle) WithHistory(n int) *Rattle {
+	if n <= 0 {
+		r.history = nil
+		return r
+	}
+	r.history = &history{entries: make([]HistoryEntry, n)}
+	return r
+}
+
+// History returns the calls kept by WithHistory, oldest first.
+func (r *Rattle) History() []HistoryEntry {
+	if r.history == nil {
+		return nil
+	}
+	return r.history.list()
+}
+
+func (h *history) add(req *http.Request, code int, duration time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = HistoryEntry{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Code:     code,
+		Duration: duration,
+		Err:      err,
+	}
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *history) list() []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]HistoryEntry{}, h.entries[:h.next]...)
+	}
+	return append(append([]HistoryEntry{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
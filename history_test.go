@@ -0,0 +1,57 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestWithHistory(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		code, _ := strconv.Atoi(req.URL.Query().Get("code"))
+		w.WriteHeader(code)
+	}))
+	defer ts.Close()
+
+	r := New().WithHistory(3)
+	for i := 0; i < 5; i++ {
+		if _, _, err := r.New().Get(fmt.Sprintf("%s?code=%d", ts.URL, 200+i)).Send(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	entries := r.History()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		code := 202 + i
+		if entry.Method != GET || entry.URL != fmt.Sprintf("%s?code=%d", ts.URL, code) || entry.Code != code {
+			t.Errorf("expected entry %d of the request with code %d, got %+v", i, code, entry)
+		}
+		if entry.Duration <= 0 || entry.Err != nil {
+			t.Errorf("expected a duration and no error, got %+v", entry)
+		}
+	}
+
+	if entries := New().History(); entries != nil {
+		t.Errorf("expected no history by default, got %v", entries)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// hostFailures remembers the hosts that recently failed to connect, see
+// Config.HostFailureTTL.
+type hostFailures struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	failed map[string]hostFailure
+}
+
+type hostFailure struct {
+	err   error
+	until time.Time
+}
+
+// newHostFailures returns a cache keeping failures for ttl, or nil if ttl
+// isn't positive.
+func newHostFailures(ttl time.Duration) *hostFailures {
+	if ttl <= 0 {
+		return nil
+	}
+	return &hostFailures{ttl: ttl, failed: make(map[string]hostFailure)}
+}
+
+// check returns the cached failure of host, or nil if it didn't fail
+// within the TTL.
+func (h *hostFailures) check(host string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	failure, ok := h.failed[host]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(failure.until) {
+		delete(h.failed, host)
+		return nil
+	}
+	return fmt.Errorf("%s failed recently: %w", host, failure.err)
+}
+
+// report caches err for host if it is a connection error, or forgets an
+// earlier failure of host if err is nil.
+func (h *hostFailures) report(host string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		delete(h.failed, host)
+		return
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		h.failed[host] = hostFailure{err: err, until: time.Now().Add(h.ttl)}
+	}
+}
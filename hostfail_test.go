@@ -0,0 +1,120 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_hostFailureTTL(t *testing.T) {
+	// find a free port, nothing listens on it until the server starts below
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	config := NewConfig()
+	config.HostFailureTTL = 200 * time.Millisecond
+	rattle := New(config)
+	if _, _, err = rattle.New().Get("http://" + addr).Send(); err == nil {
+		t.Fatalf("expected connection error")
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s again: %v", addr, err)
+	}
+	var requests int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	start := time.Now()
+	_, _, err = rattle.New().Get("http://" + addr).Send()
+	if err == nil || !strings.Contains(err.Error(), "failed recently") {
+		t.Errorf("expected the cached failure, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the cached failure at once, took %v", elapsed)
+	}
+	if requests != 0 {
+		t.Errorf("expected the host not contacted, got %d requests", requests)
+	}
+
+	time.Sleep(config.HostFailureTTL)
+	if _, code, err := rattle.New().Get("http://" + addr).Send(); err != nil || code != http.StatusOK {
+		t.Errorf("expected the host contacted after the TTL, got %d %v", code, err)
+	}
+}
+
+func TestConfig_hostFailureTTL_lastAttempt(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	// the host comes up between the attempts, but hangs up on requests
+	ready := make(chan *httptest.Server, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			ready <- nil
+			return
+		}
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+		}))
+		ts.Listener = l
+		ts.Start()
+		ready <- ts
+	}()
+
+	config := NewConfig()
+	config.HostFailureTTL = time.Minute
+	config.RetryTimes = 1
+	config.RetryInterval = 200 * time.Millisecond
+	rattle := New(config)
+	_, _, err = rattle.New().Get("http://" + addr).Send()
+	ts := <-ready
+	if ts == nil {
+		t.Skipf("can't listen on %s again", addr)
+	}
+	defer ts.Close()
+	retryErr, ok := err.(*RetryError)
+	if !ok || len(retryErr.Errors) != 2 {
+		t.Fatalf("expected a dial error then a hang up, got %v", err)
+	}
+
+	// the dial error of the first attempt isn't cached
+	if _, _, err = rattle.New().Get("http://" + addr).Send(); err == nil || strings.Contains(err.Error(), "failed recently") {
+		t.Errorf("expected the host contacted again, got %v", err)
+	}
+}
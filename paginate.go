@@ -0,0 +1,86 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PaginateLinkHeader sends the request and follows the rel="next" links of
+// the RFC 5988 Link response header until there are none, calling perPage
+// with the body of every page. The query structs only apply to the first
+// page, as next links carry their own query. Pagination stops at the first
+// error returned by perPage or a status >= 400.
+func (r *Rattle) PaginateLinkHeader(perPage func([]byte) error) error {
+	page := r
+	seen := make(map[string]bool)
+	for {
+		result, code, err := page.Send()
+		if err != nil {
+			return err
+		}
+		if code >= 400 {
+			return fmt.Errorf("%s", page.resp.Status)
+		}
+		if err = perPage(result); err != nil {
+			return err
+		}
+		next := nextLink(page.resp.Header)
+		if next == "" {
+			return nil
+		}
+		nextURL, err := page.resp.Request.URL.Parse(next)
+		if err != nil {
+			return err
+		}
+		if seen[nextURL.String()] {
+			return fmt.Errorf("pagination loop at %s", nextURL)
+		}
+		seen[nextURL.String()] = true
+		page = r.New()
+		page.rawURL = nextURL.String()
+		page.parameters = nil
+	}
+}
+
+// nextLink returns the target of the rel="next" link of the Link header,
+// or an empty string if there is none.
+func nextLink(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(kv[1], `"`)) {
+					if strings.EqualFold(rel, "next") {
+						return target[1 : len(target)-1]
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
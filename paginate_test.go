@@ -0,0 +1,77 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestPaginateLinkHeader(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if req.URL.Query().Get("count") != "" && page != 1 {
+			t.Errorf("query structs should only apply to the first page, got %s", req.URL.RawQuery)
+		}
+		links := fmt.Sprintf(`<%s/items?page=1>; rel="first"`, ts.URL)
+		if page < 3 {
+			links += fmt.Sprintf(`, </items?page=%d>; rel="next"`, page+1)
+		}
+		w.Header().Set("Link", links)
+		_, _ = fmt.Fprintf(w, "page %d", page)
+	}))
+	defer ts.Close()
+
+	var pages []string
+	err := New().Get(ts.URL + "/items?page=1").AddQuery(params).PaginateLinkHeader(func(body []byte) error {
+		pages = append(pages, string(body))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{"page 1", "page 2", "page 3"}
+	if !reflect.DeepEqual(expected, pages) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, pages)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	cases := []struct {
+		link     string
+		expected string
+	}{
+		{`<https://api.example.com/items?page=2>; rel="next", <https://api.example.com/items?page=9>; rel="last"`, "https://api.example.com/items?page=2"},
+		{`</items?page=1>; rel="prev first"`, ""},
+		{`</items?page=3>; title="more"; rel="last next"`, "/items?page=3"},
+		{``, ""},
+	}
+	for _, c := range cases {
+		header := make(http.Header)
+		if c.link != "" {
+			header.Set("Link", c.link)
+		}
+		if got := nextLink(header); got != c.expected {
+			t.Errorf("expected %q for %s, got %q", c.expected, c.link, got)
+		}
+	}
+}
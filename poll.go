@@ -0,0 +1,151 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// PollUntilJSON GETs pathURL every interval until the JSON field of the
+// response body equals want, and returns that body. Nested fields are
+// addressed with dots, e.g. "data.status". Non-string values are compared
+// by their JSON encoding. An error is returned once timeout elapses. r is
+// left as is, the polls are sent by a copy of it.
+func (r *Rattle) PollUntilJSON(pathURL, field, want string, interval time.Duration, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	poll := r.New().Get(pathURL)
+	poll.bodyProvider = nil
+	for {
+		result, code, err := poll.Send()
+		if err != nil {
+			return result, err
+		}
+		if code < 400 && jsonField(result, field) == want {
+			return result, nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return result, fmt.Errorf("polling %s: field %s did not become %q within %v", poll.rawURL, field, want, timeout)
+		}
+		if err = r.sleep(interval); err != nil {
+			return result, err
+		}
+	}
+}
+
+// operationHeaders are the request headers about the body or conditions of
+// the operation, left out of the GETs polling it.
+var operationHeaders = []string{
+	contentType, contentEncoding, "Content-Length", "Content-MD5", "Digest",
+	"Idempotency-Key", "X-Idempotency-Key",
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since",
+}
+
+// AwaitAsyncOperation sends the request and, when the server accepts it
+// with 202 Accepted, GETs the URL of its Operation-Location or Location
+// header every interval until the status is no longer 202, and returns that
+// final body, its response becoming the one of r. Other responses are
+// returned at once. A final status >= 400 is returned as error, along with
+// the body. An error is returned once timeout elapses.
+func (r *Rattle) AwaitAsyncOperation(interval, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	result, code, err := r.Send()
+	poll := r
+	for err == nil && code == http.StatusAccepted {
+		location := poll.resp.Header.Get("Operation-Location")
+		if location == "" {
+			location = poll.resp.Header.Get("Location")
+		}
+		if location == "" {
+			return result, fmt.Errorf("%s: Location not defined", poll.resp.Status)
+		}
+		// custom clients may answer without the request
+		base := poll.rawURL
+		if poll.resp.Request != nil {
+			base = poll.resp.Request.URL.String()
+		}
+		statusURL, parseErr := url.Parse(base)
+		if parseErr == nil {
+			statusURL, parseErr = statusURL.Parse(location)
+		}
+		if parseErr != nil {
+			return result, parseErr
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return result, fmt.Errorf("operation %s did not complete within %v", statusURL, timeout)
+		}
+		if err = r.sleep(interval); err != nil {
+			return result, err
+		}
+		poll = r.New()
+		poll.method = GET
+		poll.rawURL = statusURL.String()
+		poll.parameters = nil
+		poll.bodyProvider = nil
+		for _, key := range operationHeaders {
+			poll.header.Del(key)
+		}
+		result, code, err = poll.Send()
+		r.resp = poll.resp
+	}
+	if err == nil && code >= 400 {
+		err = fmt.Errorf("%s", poll.resp.Status)
+	}
+	return result, err
+}
+
+// sleep waits d, or returns the error of the context of r if it ends first.
+func (r *Rattle) sleep(d time.Duration) error {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return sleepContext(ctx, d)
+}
+
+// jsonField returns the value of the dotted field in the JSON document data.
+// Strings are returned as is, other values JSON encoded. If data isn't JSON
+// or the field doesn't exist, an empty string is returned.
+func jsonField(data []byte, field string) string {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return ""
+	}
+	for _, key := range strings.Split(field, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if doc, ok = obj[key]; !ok {
+			return ""
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
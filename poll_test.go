@@ -0,0 +1,198 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPollUntilJSON(t *testing.T) {
+	polls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		polls++
+		status := "pending"
+		if polls > 2 {
+			status = "done"
+		}
+		_, _ = fmt.Fprintf(w, `{"id":1,"status":%q}`, status)
+	}))
+	defer ts.Close()
+
+	client := New().BaseURL(ts.URL)
+	result, err := client.PollUntilJSON("/jobs/1", "status", "done", 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
+	}
+	if expected := `{"id":1,"status":"done"}`; string(result) != expected {
+		t.Errorf("expected body %s, got %s", expected, result)
+	}
+
+	if client.rawURL != ts.URL {
+		t.Errorf("expected the client left at %s, got %s", ts.URL, client.rawURL)
+	}
+
+	_, err = client.PollUntilJSON("/jobs/1", "status", "failed", 10*time.Millisecond, 50*time.Millisecond)
+	if err == nil {
+		t.Errorf("expected timeout error")
+	}
+}
+
+func TestJSONField(t *testing.T) {
+	data := []byte(`{"status":"ok","data":{"count":2,"ready":true}}`)
+	cases := map[string]string{
+		"status":     "ok",
+		"data.count": "2",
+		"data.ready": "true",
+		"missing":    "",
+		"status.sub": "",
+	}
+	for field, expected := range cases {
+		if got := jsonField(data, field); got != expected {
+			t.Errorf("expected %q for field %s, got %q", expected, field, got)
+		}
+	}
+}
+
+func TestAwaitAsyncOperation(t *testing.T) {
+	polls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs":
+			if req.Method != POST {
+				t.Errorf("expected the job created with POST, got %s", req.Method)
+			}
+			w.Header().Set("Operation-Location", "/operations/1")
+			w.WriteHeader(http.StatusAccepted)
+		case "/operations/1":
+			if req.Method != GET || req.URL.RawQuery != "" {
+				t.Errorf("expected the operation polled with a plain GET, got %s %s", req.Method, req.URL)
+			}
+			polls++
+			if polls < 3 {
+				w.Header().Set("Location", "/operations/1")
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte(`{"status":"running"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"status":"succeeded"}`))
+		case "/lost":
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer ts.Close()
+
+	rattle := New().Post(ts.URL+"/jobs").AddQuery(map[string]string{"async": "true"}).BodyJSON(testItem{ID: 1}, false)
+	result, err := rattle.AwaitAsyncOperation(10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if expected := `{"status":"succeeded"}`; string(result) != expected {
+		t.Errorf("expected body %s, got %s", expected, result)
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
+	}
+	if code := rattle.GetResponse().StatusCode; code != http.StatusOK {
+		t.Errorf("expected the final response, got %d", code)
+	}
+
+	polls = 0
+	if _, err = New().Post(ts.URL+"/jobs").AwaitAsyncOperation(10*time.Millisecond, 15*time.Millisecond); err == nil {
+		t.Errorf("expected timeout error")
+	}
+	if _, err = New().Post(ts.URL+"/lost").AwaitAsyncOperation(10*time.Millisecond, time.Second); err == nil {
+		t.Errorf("expected error for 202 without Location")
+	}
+}
+
+func TestAwaitAsyncOperation_pollRequest(t *testing.T) {
+	var polled http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/jobs" {
+			w.Header().Set("Location", "/operations/1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		polled = req.Header
+	}))
+	defer ts.Close()
+
+	rattle := New().Post(ts.URL+"/jobs").BodyJSON(testItem{ID: 1}, false).
+		SetHeader("Idempotency-Key", "job-1").SetHeader("If-Match", `"v1"`).SetHeader("X-Tenant", "acme")
+	if _, err := rattle.AwaitAsyncOperation(time.Millisecond, time.Second); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, key := range []string{"Idempotency-Key", "If-Match", "Content-Type"} {
+		if value := polled.Get(key); value != "" {
+			t.Errorf("expected no %s polling, got %q", key, value)
+		}
+	}
+	if tenant := polled.Get("X-Tenant"); tenant != "acme" {
+		t.Errorf("expected the other headers kept polling, got %q", tenant)
+	}
+}
+
+func TestAwaitAsyncOperation_noRequest(t *testing.T) {
+	var polled []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		polled = append(polled, req.URL.String())
+		resp := &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: http.NoBody}
+		if len(polled) == 1 {
+			resp.StatusCode, resp.Status = http.StatusAccepted, "202 Accepted"
+			resp.Header.Set("Location", "/operations/1")
+		}
+		return resp, nil
+	})}
+
+	if _, err := New().SetHTTPClient(client).Post("http://example.com/jobs").AwaitAsyncOperation(time.Millisecond, time.Second); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if expected := "http://example.com/operations/1"; len(polled) != 2 || polled[1] != expected {
+		t.Errorf("expected %s polled, got %v", expected, polled)
+	}
+}
+
+func TestPoll_context(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", "/operations/1")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status":"running"}`))
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := New().WithContext(ctx).Post(ts.URL).AwaitAsyncOperation(time.Second, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if _, err := New().WithContext(ctx).BaseURL(ts.URL).PollUntilJSON("/", "status", "done", time.Second, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the polls to stop with the context, took %v", elapsed)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// PreparedRattle is a request built once by Prepare and sent many times.
+// Like Rattle it isn't safe for concurrent use.
+type PreparedRattle struct {
+	rattle *Rattle
+	req    *http.Request
+	body   []byte
+}
+
+// Prepare builds the request once, buffering its body, so sending it again
+// skips encoding the URL, the query structs and the body. Changes made to
+// the Rattle afterwards don't affect the prepared request, but the response
+// and stats of its sends are available on the Rattle as usual.
+func (r *Rattle) Prepare() (*PreparedRattle, error) {
+	req, err := r.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	p := &PreparedRattle{rattle: r, req: req}
+	if req.Body != nil && req.Body != http.NoBody {
+		p.body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Send sends the prepared request with a fresh copy of its body.
+func (p *PreparedRattle) Send() ([]byte, int, error) {
+	req := p.req.Clone(p.req.Context())
+	if p.body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(p.body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(p.body)), nil
+		}
+		req.ContentLength = int64(len(p.body))
+	}
+	return p.rattle.Do(req)
+}
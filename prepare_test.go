@@ -0,0 +1,87 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		_, _ = w.Write([]byte(req.URL.RawQuery + " " + string(body)))
+	}))
+}
+
+func TestPrepare(t *testing.T) {
+	ts := newEchoServer()
+	defer ts.Close()
+
+	rattle := New().Post(ts.URL).AddQuery(params).BodyJSON(testItem{ID: 1, Name: "a"}, true)
+	prepared, err := rattle.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// later changes don't affect the prepared request
+	rattle.AddQuery(TestParams{Name: "other"})
+	expected := "count=25&name=recent {\"id\":1,\"name\":\"a\"}\n"
+	for i := 0; i < 3; i++ {
+		result, code, err := prepared.Send()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if code != http.StatusOK || string(result) != expected {
+			t.Errorf("send %d: expected 200 %q, got %d %q", i, expected, code, result)
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	ts := newEchoServer()
+	defer ts.Close()
+	config := NewConfig()
+	config.ReUseTCP = true
+	rattle := New(config).Post(ts.URL).AddQuery(params).BodyJSON(testItem{ID: 1, Name: "a"}, true)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := rattle.Send(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPreparedSend(b *testing.B) {
+	ts := newEchoServer()
+	defer ts.Close()
+	config := NewConfig()
+	config.ReUseTCP = true
+	prepared, err := New(config).Post(ts.URL).AddQuery(params).BodyJSON(testItem{ID: 1, Name: "a"}, true).Prepare()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := prepared.Send(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// proxyRotation hands out proxies round-robin, skipping the ones that
+// failed Config.ProxyMaxFailures times in a row.
+type proxyRotation struct {
+	mu          sync.Mutex
+	proxies     []*url.URL
+	failures    []int
+	next        int
+	maxFailures int
+}
+
+// proxyChoiceKey is the context key of the *proxyChoice of a request.
+type proxyChoiceKey struct{}
+
+// proxyChoice is the rotation a request is sent through and the index of
+// the proxy picked for its attempt.
+type proxyChoice struct {
+	rotation *proxyRotation
+	idx      int
+}
+
+// pick returns the next live proxy and its index.
+func (p *proxyRotation) pick() (int, *url.URL, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.proxies {
+		idx := (p.next + i) % len(p.proxies)
+		if p.maxFailures <= 0 || p.failures[idx] < p.maxFailures {
+			p.next = idx + 1
+			return idx, p.proxies[idx], nil
+		}
+	}
+	return -1, nil, errors.New("all proxies failed")
+}
+
+// report records the outcome of an attempt through the proxy idx.
+func (p *proxyRotation) report(idx int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failures[idx]++
+	} else {
+		p.failures[idx] = 0
+	}
+}
+
+// WithProxyRotation sends each request through the next of the proxies in
+// turn. A proxy failing Config.ProxyMaxFailures requests in a row is
+// skipped from then on. Rattles created by New share the rotation, and the
+// settings of Config.UseProxy are replaced. The rattles of a client with
+// rotations share their connections.
+func (r *Rattle) WithProxyRotation(proxies []string) *Rattle {
+	if len(proxies) == 0 {
+		return r
+	}
+	rotation := &proxyRotation{failures: make([]int, len(proxies)), maxFailures: r.config.ProxyMaxFailures}
+	for _, proxy := range proxies {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return r.setErr(fmt.Errorf("proxy %q: %v", proxy, err))
+		}
+		rotation.proxies = append(rotation.proxies, proxyURL)
+	}
+	transport, ok := r.httpClient.Transport.(*http.Transport)
+	if !ok {
+		return r.setErr(fmt.Errorf("proxy rotation needs an *http.Transport, got %T", r.httpClient.Transport))
+	}
+	// derived once, the rotation comes with each request, see sendProxied
+	transport = r.transports.derive(transport, "proxyRotation", func(transport *http.Transport) {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			choice, ok := req.Context().Value(proxyChoiceKey{}).(*proxyChoice)
+			if !ok {
+				return nil, errors.New("request without proxy rotation")
+			}
+			idx, proxyURL, err := choice.rotation.pick()
+			choice.idx = idx
+			return proxyURL, err
+		}
+	})
+	client := *r.httpClient
+	client.Transport = transport
+	r.httpClient = &client
+	r.proxies = rotation
+	return r
+}
+
+// sendProxied sends req through the proxy rotation, reporting the outcome
+// for the proxy used.
+func (r *Rattle) sendProxied(req *http.Request) (*http.Response, error) {
+	choice := &proxyChoice{rotation: r.proxies, idx: -1}
+	resp, err := r.client().Do(req.WithContext(context.WithValue(req.Context(), proxyChoiceKey{}, choice)))
+	if choice.idx >= 0 {
+		r.proxies.report(choice.idx, err)
+	}
+	return resp, err
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestProxy returns a server answering proxied requests with its name.
+func newTestProxy(t *testing.T, name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !req.URL.IsAbs() {
+			t.Errorf("expected a proxied request, got %s", req.URL)
+		}
+		_, _ = w.Write([]byte(name))
+	}))
+}
+
+func TestWithProxyRotation(t *testing.T) {
+	var proxies []string
+	for _, name := range []string{"a", "b", "c"} {
+		ts := newTestProxy(t, name)
+		defer ts.Close()
+		proxies = append(proxies, ts.URL)
+	}
+
+	parent := New().WithProxyRotation(proxies)
+	used := make(map[string]bool)
+	for i := 0; i < len(proxies); i++ {
+		result, _, err := parent.New().Get("http://rattle.test/").Send()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		used[string(result)] = true
+	}
+	if len(used) != len(proxies) {
+		t.Errorf("expected each request through a different proxy, got %v", used)
+	}
+	if _, _, err := New().Get("http://rattle.test/").Send(); err == nil {
+		t.Errorf("expected the host not to resolve without the proxies")
+	}
+}
+
+func TestWithProxyRotation_sharedPool(t *testing.T) {
+	proxy := newTestProxy(t, "a")
+	defer proxy.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	parent := New(config)
+	for i := 0; i < 2; i++ {
+		if _, _, err := parent.New().WithProxyRotation([]string{proxy.URL}).Get("http://rattle.test/").Send(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if stats := parent.PoolStats(); stats.ConnectionsCreated != 1 || stats.ConnectionsReused != 1 {
+		t.Errorf("expected the rotating rattles to share the connection, got %+v", stats)
+	}
+}
+
+func TestWithProxyRotation_deadProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	dead := "http://" + listener.Addr().String()
+	_ = listener.Close()
+	live := newTestProxy(t, "live")
+	defer live.Close()
+
+	config := NewConfig()
+	config.ProxyMaxFailures = 1
+	rattle := New(config).WithProxyRotation([]string{dead, live.URL})
+	if _, _, err = rattle.New().Get("http://rattle.test/").Send(); err == nil {
+		t.Errorf("expected the dead proxy to fail")
+	}
+	for i := 0; i < 3; i++ {
+		result, _, err := rattle.New().Get("http://rattle.test/").Send()
+		if err != nil || string(result) != "live" {
+			t.Errorf("expected the dead proxy skipped, got %q %v", result, err)
+		}
+	}
+
+	if _, _, err = New().WithProxyRotation([]string{"http://[::1"}).Get("http://rattle.test/").Send(); err == nil {
+		t.Errorf("expected error for an invalid proxy URL")
+	}
+}
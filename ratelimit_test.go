@@ -0,0 +1,80 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig_rateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RateLimit = 2
+	parent := New(config).Get(ts.URL)
+	const requests = 4
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := parent.New().Send(); err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed, min := time.Since(start), (requests-1)*500*time.Millisecond; elapsed < min {
+		t.Errorf("expected the children throttled to at least %v, took %v", min, elapsed)
+	}
+
+	// waiting respects the request context
+	_, _, err := parent.New().Timeout(50 * time.Millisecond).Send()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded while waiting, got %v", err)
+	}
+}
+
+func TestConfig_rateLimitDigest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", `Digest realm="rattle", qop="auth", nonce="abc"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RateLimit = 1
+	start := time.Now()
+	_, code, err := New(config).Get(ts.URL).SetDigestAuth("user", "secret").Send()
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("unexpected result %d %v", code, err)
+	}
+	// the answer to the challenge is throttled like any attempt
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the digest round trip throttled to at least 1s, took %v", elapsed)
+	}
+}
@@ -19,13 +19,23 @@ package rattle
 import (
   "crypto/tls"
   "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
   goquery "github.com/google/go-querystring/query"
   "golang.org/x/net/context"
+  "golang.org/x/sync/singleflight"
+  "google.golang.org/protobuf/proto"
   "io"
   "io/ioutil"
   "net"
   "net/http"
   "net/url"
+  "reflect"
+  "strconv"
+  "strings"
+  "sync/atomic"
+  "time"
 )
 
 type Rattle struct {
@@ -45,23 +55,122 @@ type Rattle struct {
   config Config
   // http.Response
   resp *http.Response
+  // absolute socket deadline of each request, relative to the start of Do
+  socketDeadline time.Duration
+  // multipart boundary of file bodies, random if empty
+  multipartBoundary string
+  // Accept-Language values rotated per request
+  acceptLanguages    []string
+  acceptLanguageNext uint32
+  // header profiles picked at random per request
+  fingerprints []HeaderProfile
+  // measurements of the last request
+  stats Stats
+  // raw bytes of the last request, see Config.CaptureWire
+  wire *wireLog
+  // credentials answering Digest challenges
+  digest *digestAuth
+  // identical requests in flight, see Config.SingleFlight
+  flight *singleflight.Group
+  // connections open on the client, see OpenConnections
+  openConns *int64
+  // proxies used in turn, see WithProxyRotation
+  proxies *proxyRotation
+  // last calls of Do, see WithHistory
+  history *history
+  // attempts throttle, see Config.RateLimit
+  limiter *rateLimiter
+  // hosts failing to connect, see Config.HostFailureTTL
+  hostFailures *hostFailures
+  // connection counters of the client, see PoolStats
+  pool *poolCounters
+  // transports derived from the one of the client, see derive
+  transports *transportCache
+  // first error of the builder methods, returned by GetRequest
+  err error
+  // error of the last BaseURL call, if any
+  baseURLErr error
+  // retry responses that aren't JSON
+  requireJSON bool
+  // context of the generated requests
+  ctx context.Context
+  // Accept types tried in order while the server answers 406
+  acceptTypes []string
+  // time allowed to read request bodies, relative to the start of Do
+  bodyDeadline time.Duration
+  // limit of each call, retries included
+  timeout time.Duration
+  // absolute limit of the calls, see WithHardDeadline
+  hardDeadline time.Time
+  // read/write timeout of the connections per attempt, see SetDynamicTimeout
+  dynamicTimeout func(attempt int) time.Duration
+  // redirects followed at most, if limitRedirects
+  maxRedirects   int
+  limitRedirects bool
+  // latency beyond which Do returns ErrSLAViolation
+  maxLatency time.Duration
+  // response header holding the digest of the body, see VerifyChecksumHeader
+  checksum *checksumHeader
+  // gzip request bodies larger than compressThreshold bytes
+  compress          bool
+  compressThreshold int
 }
 
-func New(cfg ...*Config) *Rattle {
+// New returns a Rattle using the default config, changed by the given
+// options, e.g. New(config), New(config, WithRetries(3)) or
+// New(WithConnectTimeout(time.Second), WithRetries(3)). A *Config is an
+// Option, so New(config) works as before, but a []*Config has to be passed
+// as New(configs[0]) now instead of New(configs...).
+func New(opts ...Option) *Rattle {
   config := NewConfig()
-  if len(cfg) > 0 {
-    config = cfg[0]
+  for _, opt := range opts {
+    opt.apply(config)
   }
+  r := &Rattle{
+    httpClient:   config.HTTPClient,
+    method:       GET,
+    header:       make(http.Header),
+    parameters:   make([]interface{}, 0),
+    config:       *config,
+    flight:       new(singleflight.Group),
+    openConns:    new(int64),
+    limiter:      newRateLimiter(config.RateLimit),
+    hostFailures: newHostFailures(config.HostFailureTTL),
+    pool:         new(poolCounters),
+    transports:   new(transportCache),
+  }
+  if r.httpClient != nil {
+    return r
+  }
+  openConns := r.openConns
   transport := &http.Transport{
     DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-      conn, err := net.DialTimeout(network, addr, config.HTTPTimeout.ConnectTimeout)
+      dialer := &net.Dialer{Timeout: config.HTTPTimeout.ConnectTimeout, Resolver: config.Resolver}
+      conn, err := dialer.DialContext(ctx, network, addr)
       if err != nil {
         return nil, err
       }
-      return newTimeoutConn(conn, config.HTTPTimeout), nil
+      if err = tuneConn(conn, config); err != nil {
+        _ = conn.Close()
+        return nil, err
+      }
+      tc := newTimeoutConn(conn, config.HTTPTimeout)
+      atomic.AddInt64(openConns, 1)
+      tc.onClose = func() {
+        atomic.AddInt64(openConns, -1)
+      }
+      return tc, nil
     },
+    MaxConnsPerHost:       config.MaxConnsPerHost,
     ResponseHeaderTimeout: config.HTTPTimeout.HeaderTimeout,
-    TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+    TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+    TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify, MinVersion: config.MinTLSVersion},
+  }
+  if config.TLSConfig != nil {
+    transport.TLSClientConfig = config.TLSConfig.Clone()
+    if transport.TLSClientConfig.MinVersion < config.MinTLSVersion {
+      transport.TLSClientConfig.MinVersion = config.MinTLSVersion
+    }
   }
 
   // Proxy
@@ -74,34 +183,97 @@ func New(cfg ...*Config) *Rattle {
       transport.Proxy = http.ProxyURL(proxyURL)
     }
   }
-  return &Rattle{
-    httpClient: &http.Client{Transport: transport},
-    method:     GET,
-    header:     make(http.Header),
-    parameters: make([]interface{}, 0),
+  checkRedirect := config.CheckRedirect
+  if config.DisableRedirects {
+    checkRedirect = func(req *http.Request, via []*http.Request) error {
+      return http.ErrUseLastResponse
+    }
   }
+  r.httpClient = &http.Client{Transport: transport, Jar: config.CookieJar, CheckRedirect: checkRedirect}
+  return r
 }
 
 func (r *Rattle) New() *Rattle {
   // copy Headers pairs into new Header map
   headerCopy := make(http.Header)
   for k, v := range r.header {
-    headerCopy[k] = v
+    headerCopy[k] = append([]string(nil), v...)
   }
   return &Rattle{
-    httpClient:   r.httpClient,
-    method:       r.method,
-    rawURL:       r.rawURL,
-    header:       headerCopy,
-    parameters:   append([]interface{}{}, r.parameters...),
-    bodyProvider: r.bodyProvider,
+    httpClient:        r.httpClient,
+    method:            r.method,
+    rawURL:            r.rawURL,
+    header:            headerCopy,
+    parameters:        append([]interface{}{}, r.parameters...),
+    bodyProvider:      r.bodyProvider,
+    config:            r.config,
+    socketDeadline:    r.socketDeadline,
+    bodyDeadline:      r.bodyDeadline,
+    timeout:           r.timeout,
+    hardDeadline:      r.hardDeadline,
+    maxLatency:        r.maxLatency,
+    dynamicTimeout:    r.dynamicTimeout,
+    maxRedirects:      r.maxRedirects,
+    limitRedirects:    r.limitRedirects,
+    checksum:          r.checksum,
+    compress:          r.compress,
+    compressThreshold: r.compressThreshold,
+    multipartBoundary: r.multipartBoundary,
+    acceptLanguages:   r.acceptLanguages,
+    fingerprints:      r.fingerprints,
+    digest:            r.digest,
+    flight:            r.flight,
+    openConns:         r.openConns,
+    proxies:           r.proxies,
+    limiter:           r.limiter,
+    hostFailures:      r.hostFailures,
+    history:           r.history,
+    pool:              r.pool,
+    transports:        r.transports,
+    err:               r.err,
+    baseURLErr:        r.baseURLErr,
+    requireJSON:       r.requireJSON,
+    ctx:               r.ctx,
+    acceptTypes:       r.acceptTypes,
+  }
+}
+
+// Err returns the first error of the builder methods, e.g. an invalid
+// argument. GetRequest and Send return it instead of sending.
+func (r *Rattle) Err() error {
+  return r.err
+}
+
+// setErr records err unless an earlier error is already recorded.
+func (r *Rattle) setErr(err error) *Rattle {
+  if r.err == nil {
+    r.err = err
   }
+  return r
 }
 
 // Base sets the rawURL. If you intend to extend the url with Path,
-// baseUrl should be specified with a trailing slash.
+// baseUrl should be specified with a trailing slash. The scheme and host
+// are lowercased. A URL that isn't absolute is recorded as error, see Err.
 func (r *Rattle) BaseURL(rawURL string) *Rattle {
+  // a new base URL replaces the error of the previous one
+  if r.err != nil && r.err == r.baseURLErr {
+    r.err = nil
+  }
+  r.baseURLErr = nil
   r.rawURL = rawURL
+  baseURL, err := url.Parse(rawURL)
+  if err != nil {
+    r.baseURLErr = fmt.Errorf("BaseURL: %v", err)
+    return r.setErr(r.baseURLErr)
+  }
+  if baseURL.Scheme == "" || baseURL.Host == "" {
+    r.baseURLErr = fmt.Errorf("BaseURL: %q is not an absolute URL", rawURL)
+    return r.setErr(r.baseURLErr)
+  }
+  baseURL.Scheme = strings.ToLower(baseURL.Scheme)
+  baseURL.Host = strings.ToLower(baseURL.Host)
+  r.rawURL = baseURL.String()
   return r
 }
 
@@ -158,6 +330,17 @@ func (r *Rattle) setPath(path string) *Rattle {
   return r
 }
 
+// SetHTTPClient replaces the client sending the requests, e.g. with one
+// using a stub http.RoundTripper in tests. Rattles created by New share it.
+// The transport settings of Config don't apply to it.
+func (r *Rattle) SetHTTPClient(client *http.Client) *Rattle {
+  if client == nil {
+    return r
+  }
+  r.httpClient = client
+  return r
+}
+
 // SetHeader sets the key, value pair in Headers, replacing existing values
 // associated with key. Header keys are canonicalized.
 func (r *Rattle) SetHeader(key, value string) *Rattle {
@@ -165,6 +348,31 @@ func (r *Rattle) SetHeader(key, value string) *Rattle {
   return r
 }
 
+// SetHeaders sets each key, value pair of headers like SetHeader.
+func (r *Rattle) SetHeaders(headers map[string]string) *Rattle {
+  for key, value := range headers {
+    r.header.Set(key, value)
+  }
+  return r
+}
+
+// AddHeader adds the key, value pair in Headers, appending to any existing
+// values associated with key. Header keys are canonicalized.
+func (r *Rattle) AddHeader(key, value string) *Rattle {
+  r.header.Add(key, value)
+  return r
+}
+
+// IfMatch sets the If-Match header, so the request only applies while the
+// resource still has the entity tag etag, for optimistic concurrency. Bare
+// tags are quoted. Do returns ErrPreconditionFailed if it changed.
+func (r *Rattle) IfMatch(etag string) *Rattle {
+  if etag != "*" && !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+    etag = strconv.Quote(etag)
+  }
+  return r.SetHeader("If-Match", etag)
+}
+
 // SetBasicAuth sets the Authorization header to use HTTP Basic Authentication
 // with the provided username and password. With HTTP Basic Authentication
 // the provided username and password are not encrypted.
@@ -172,6 +380,12 @@ func (r *Rattle) SetBasicAuth(username, password string) *Rattle {
   return r.SetHeader("Authorization", "Basic "+genBasicAuth(username, password))
 }
 
+// SetBearerToken sets the Authorization header to use the Bearer token, e.g.
+// of OAuth 2.0 or a JWT, replacing any other credentials.
+func (r *Rattle) SetBearerToken(token string) *Rattle {
+  return r.SetHeader("Authorization", "Bearer "+token)
+}
+
 // genBasicAuth returns the Host64 encoded username:password for basic auth copied
 // from net/http.
 func genBasicAuth(username, password string) string {
@@ -204,29 +418,216 @@ func (r *Rattle) BodyJSON(bodyJSON interface{}, escapeHTML bool) *Rattle {
   return r.setbodyProvider(bodyProviderJson{body: bodyJSON, escapeHTML: escapeHTML})
 }
 
+// BodyXML sets the xml body
+func (r *Rattle) BodyXML(bodyXML interface{}) *Rattle {
+  if bodyXML == nil {
+    return r
+  }
+  return r.setbodyProvider(bodyProviderXml{body: bodyXML})
+}
+
 // BodyForm sets the form body
 func (r *Rattle) BodyForm(bodyForm interface{}) *Rattle {
   if bodyForm == nil {
     return r
   }
-  return r.setbodyProvider(bodyProviderForm{body: bodyForm})
+  return r.setbodyProvider(bodyProviderForm{body: bodyForm, preserveOrder: r.config.FormPreserveOrder})
+}
+
+// BodyFormOrdered sets the form body of the key/value pairs, encoded in the
+// given order, e.g. for signed forms. Keys may repeat.
+func (r *Rattle) BodyFormOrdered(pairs [][2]string) *Rattle {
+  if pairs == nil {
+    return r
+  }
+  return r.setbodyProvider(bodyProviderFormPairs{pairs: append([][2]string{}, pairs...)})
+}
+
+// BodyProto sets the protobuf body
+func (r *Rattle) BodyProto(bodyProto proto.Message) *Rattle {
+  if bodyProto == nil {
+    return r
+  }
+  return r.setbodyProvider(bodyProviderProto{body: bodyProto})
+}
+
+// BodyMsgPack sets the MessagePack body
+func (r *Rattle) BodyMsgPack(bodyMsgPack interface{}) *Rattle {
+  if bodyMsgPack == nil {
+    return r
+  }
+  return r.setbodyProvider(bodyProviderMsgPack{body: bodyMsgPack})
+}
+
+// BodyFunc sets a body built lazily by fn. fn is called every time the
+// request is generated or sent again, on retries or 307/308 redirects, so it
+// must return a fresh reader on each call. The body is sent without
+// Content-Length, since it may change from one call to the next.
+func (r *Rattle) BodyFunc(fn func() (io.Reader, string, error)) *Rattle {
+  if fn == nil {
+    return r
+  }
+  return r.setbodyProvider(&bodyProviderFunc{fn: fn})
 }
 
 // BodyFile sets the send file. The value pointed to by the bodyForm
 func (r *Rattle) BodyFile(fields interface{}, file bodyProviderFileStruct) *Rattle {
-  return r.setbodyProvider(bodyProviderFile{body: fields, file: file})
+  return r.BodyFiles(fields, file)
+}
+
+// BodyFiles sets several files to send in one multipart body, each as its
+// own part, along with the form fields.
+func (r *Rattle) BodyFiles(fields interface{}, files ...bodyProviderFileStruct) *Rattle {
+  return r.setbodyProvider(bodyProviderFile{body: fields, files: files, boundary: r.multipartBoundary})
+}
+
+// MultipartBoundary sets a fixed boundary for multipart file bodies instead
+// of a random one. See https://golang.org/pkg/mime/multipart/#Writer.SetBoundary
+// for the allowed characters.
+func (r *Rattle) MultipartBoundary(boundary string) *Rattle {
+  r.multipartBoundary = boundary
+  if p, ok := r.bodyProvider.(bodyProviderFile); ok {
+    p.boundary = boundary
+    r.bodyProvider = p
+  }
+  return r
+}
+
+// CompressBodyIfLarger gzips request bodies larger than threshold bytes and
+// sets their Content-Encoding. Smaller bodies are sent as they are, not
+// worth the cost. The body is buffered to measure it.
+func (r *Rattle) CompressBodyIfLarger(threshold int) *Rattle {
+  r.compress = true
+  r.compressThreshold = threshold
+  return r
+}
+
+// WithContext sets the context of the generated requests, so they can be
+// cancelled or given a deadline. Retries stop once the context is done.
+func (r *Rattle) WithContext(ctx context.Context) *Rattle {
+  r.ctx = ctx
+  return r
+}
+
+// Timeout limits each call sending the request, retries and reading the
+// body included, to d, without changing the shared client. Shorter than
+// Config.HTTPTimeout it wins, the configured timeouts still apply otherwise.
+func (r *Rattle) Timeout(d time.Duration) *Rattle {
+  r.timeout = d
+  return r
+}
+
+// MaxRedirects limits the redirects followed by each call to n, 0 to follow
+// none. More redirects fail with an error. On 307 and 308 redirects the body
+// is sent again, if it can be produced again, see BodyOriginal.
+func (r *Rattle) MaxRedirects(n int) *Rattle {
+  r.maxRedirects = n
+  r.limitRedirects = true
+  return r
+}
+
+// client returns the client sending the requests, limited by MaxRedirects.
+func (r *Rattle) client() *http.Client {
+  if !r.limitRedirects {
+    return r.httpClient
+  }
+  client := *r.httpClient
+  max, checkRedirect := r.maxRedirects, r.httpClient.CheckRedirect
+  client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+    if len(via) > max {
+      return fmt.Errorf("stopped after %d redirects", max)
+    }
+    if checkRedirect != nil {
+      return checkRedirect(req, via)
+    }
+    return nil
+  }
+  return &client
+}
+
+// WithHardDeadline makes the calls fail once t passes, whatever phase they
+// are in: dialing, waiting for the response headers or reading the body.
+// Like Timeout it doesn't change the shared client, the earlier of both wins.
+func (r *Rattle) WithHardDeadline(t time.Time) *Rattle {
+  r.hardDeadline = t
+  return r
+}
+
+// withTimeout returns req limited by the timeout and the hard deadline, and
+// the func releasing it.
+func (r *Rattle) withTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+  deadline := r.hardDeadline
+  if r.timeout > 0 {
+    if t := time.Now().Add(r.timeout); deadline.IsZero() || t.Before(deadline) {
+      deadline = t
+    }
+  }
+  if deadline.IsZero() {
+    return req, func() {}
+  }
+  ctx, cancel := context.WithDeadline(req.Context(), deadline)
+  return req.WithContext(ctx), cancel
+}
+
+// SetDynamicTimeout replaces the read and write timeouts of Config.HTTPTimeout
+// by fn(attempt) for each attempt, 0 for the first one, 1 for the first retry
+// and so on, e.g. to give retries more time. A result <= 0 keeps the
+// configured timeouts. It has no effect with Config.HTTPClient.
+func (r *Rattle) SetDynamicTimeout(fn func(attempt int) time.Duration) *Rattle {
+  r.dynamicTimeout = fn
+  return r
+}
+
+// WithSocketDeadline limits each request to d in total on the socket. Unlike
+// the per read/write timeouts of Config.HTTPTimeout the deadline is absolute,
+// so a server trickling data can't keep the connection alive past it.
+func (r *Rattle) WithSocketDeadline(d time.Duration) *Rattle {
+  r.socketDeadline = d
+  return r
+}
+
+// BodyDeadline limits reading the request body to d, retries included. Once
+// it passes, or the request context is done, the send aborts with
+// ErrBodyDeadline or the context error, even while the body blocks.
+func (r *Rattle) BodyDeadline(d time.Duration) *Rattle {
+  r.bodyDeadline = d
+  return r
+}
+
+// withBodyDeadline wraps the body of req, and those produced for retries,
+// to fail reads past the body deadline.
+func (r *Rattle) withBodyDeadline(req *http.Request, start time.Time) *http.Request {
+  if r.bodyDeadline <= 0 || req.Body == nil || req.Body == http.NoBody {
+    return req
+  }
+  deadline := start.Add(r.bodyDeadline)
+  req = req.WithContext(req.Context())
+  req.Body = newDeadlineReader(req.Body, req.Context(), deadline)
+  if getBody := req.GetBody; getBody != nil {
+    req.GetBody = func() (io.ReadCloser, error) {
+      body, err := getBody()
+      if err != nil {
+        return nil, err
+      }
+      return newDeadlineReader(body, req.Context(), deadline), nil
+    }
+  }
+  return req
 }
 
 // GetRequest returns a new http.Request created with the request properties.
 // Returns any errors parsing the rawURL, encoding query structs, encoding
 // the body, or creating the http.Request.
 func (r *Rattle) GetRequest() (*http.Request, error) {
+  if r.err != nil {
+    return nil, r.err
+  }
   reqURL, err := url.Parse(r.rawURL)
   if err != nil {
     return nil, err
   }
 
-  err = genQuery(reqURL, r.parameters)
+  err = genQuery(reqURL, r.parameters, r.config.QueryTimeFormat, r.config.QuerySpaceAsPercent20)
   if err != nil {
     return nil, err
   }
@@ -239,14 +640,46 @@ func (r *Rattle) GetRequest() (*http.Request, error) {
       return nil, err
     }
   }
+  if body != nil && reqContentType == "" && r.config.SniffContentType {
+    body, reqContentType, err = sniffContentType(body)
+    if err != nil {
+      return nil, err
+    }
+  }
+  compressed := false
+  if body != nil && r.compress {
+    body, compressed, err = gzipIfLarger(body, r.compressThreshold)
+    if err != nil {
+      return nil, err
+    }
+  }
   req, err := http.NewRequest(r.method, reqURL.String(), body)
   if err != nil {
     return nil, err
   }
+  if _, lazy := r.bodyProvider.(*bodyProviderFunc); body != nil && lazy {
+    // BodyFunc is called again for every resend, its bodies may differ in
+    // length
+    req.GetBody = bodyGetter(r.bodyProvider)
+    if compressed {
+      req.GetBody = gzipGetter(req.GetBody)
+    }
+    req.ContentLength = -1
+  } else if body != nil && req.GetBody == nil {
+    // http.NewRequest only knows how to replay in-memory readers
+    req.GetBody = bodyGetter(r.bodyProvider)
+  }
+  if r.ctx != nil {
+    req = req.WithContext(r.ctx)
+  }
   if !r.config.ReUseTCP {
     req.Close = true
   }
   setHeaders(req, r.header)
+  r.rotateHeaders(req)
+  if r.config.DedupeHeaders {
+    dedupeHeaders(req.Header)
+  }
   if req.Header.Get("User-Agent") == "" {
     req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/72.0.3626.119 Safari/537.36")
   }
@@ -256,24 +689,53 @@ func (r *Rattle) GetRequest() (*http.Request, error) {
   } else {
     req.Header.Del(contentType)
   }
+  if compressed {
+    req.Header.Set(contentEncoding, "gzip")
+  }
 
   return req, err
 }
 
 // genQuery parses url tagged query structs using go-querystring to
-// encode them to url.Values and format them onto the url.RawQuery. Any
-// query parsing or encoding errors are returned.
-func genQuery(reqURL *url.URL, params []interface{}) error {
+// encode them to url.Values and format them onto the url.RawQuery. Maps
+// and url.Values are merged directly. If timeFormat is set, time.Time
+// fields are re-encoded with it. Spaces are encoded as "+", or as "%20"
+// if spaceAsPercent20. Any query parsing or encoding errors are returned.
+func genQuery(reqURL *url.URL, params []interface{}, timeFormat string, spaceAsPercent20 bool) error {
   urlValues, err := url.ParseQuery(reqURL.RawQuery)
   if err != nil {
     return err
   }
   // encodes query structs into a url.Values map and merges maps
   for _, param := range params {
+    if b, ok := param.(binaryQuery); ok {
+      urlValues.Add(b.key, base64.RawURLEncoding.EncodeToString(b.data))
+      continue
+    }
+    switch v := param.(type) {
+    case url.Values:
+      for key, values := range v {
+        urlValues[key] = append(urlValues[key], values...)
+      }
+      continue
+    case map[string][]string:
+      for key, values := range v {
+        urlValues[key] = append(urlValues[key], values...)
+      }
+      continue
+    case map[string]string:
+      for key, value := range v {
+        urlValues.Add(key, value)
+      }
+      continue
+    }
     queryValues, err := goquery.Values(param)
     if err != nil {
       return err
     }
+    if timeFormat != "" {
+      formatQueryTimes(param, queryValues, timeFormat)
+    }
     for key, values := range queryValues {
       for _, value := range values {
         urlValues.Add(key, value)
@@ -282,9 +744,62 @@ func genQuery(reqURL *url.URL, params []interface{}) error {
   }
   // url.Values format to a sorted "url encoded" string, e.g. "key=val&foo=bar"
   reqURL.RawQuery = urlValues.Encode()
+  if spaceAsPercent20 {
+    // a literal "+" is encoded as "%2B", any "+" left is a space
+    reqURL.RawQuery = strings.Replace(reqURL.RawQuery, "+", "%20", -1)
+  }
   return nil
 }
 
+// formatQueryTimes replaces the encoded value of every url tagged time.Time
+// field of the query struct with the given layout, or with the Unix
+// timestamp when layout is "unix". Fields omitted by go-querystring are left out.
+func formatQueryTimes(param interface{}, values url.Values, layout string) {
+  v := reflect.ValueOf(param)
+  for v.Kind() == reflect.Ptr {
+    if v.IsNil() {
+      return
+    }
+    v = v.Elem()
+  }
+  if v.Kind() != reflect.Struct {
+    return
+  }
+  t := v.Type()
+  for i := 0; i < t.NumField(); i++ {
+    field := t.Field(i)
+    if field.PkgPath != "" {
+      continue
+    }
+    name := strings.Split(field.Tag.Get("url"), ",")[0]
+    if name == "-" {
+      continue
+    }
+    if name == "" {
+      name = field.Name
+    }
+    if _, ok := values[name]; !ok {
+      continue
+    }
+    fv := v.Field(i)
+    if fv.Kind() == reflect.Ptr {
+      if fv.IsNil() {
+        continue
+      }
+      fv = fv.Elem()
+    }
+    tm, ok := fv.Interface().(time.Time)
+    if !ok {
+      continue
+    }
+    if layout == "unix" {
+      values.Set(name, strconv.FormatInt(tm.Unix(), 10))
+    } else {
+      values.Set(name, tm.Format(layout))
+    }
+  }
+}
+
 // setHeaders adds the key, value pairs from the given http.Header to the
 // Rattle. Values for existing keys are appended to the keys values.
 func setHeaders(req *http.Request, headers http.Header) {
@@ -300,6 +815,49 @@ func (r *Rattle) GetResponse() *http.Response {
   return r.resp
 }
 
+// ResponseHeaderAll returns all values of the response header key of the
+// last request, nil without a response.
+func (r *Rattle) ResponseHeaderAll(key string) []string {
+  if r.resp == nil {
+    return nil
+  }
+  return r.resp.Header.Values(key)
+}
+
+// ResponseHeaderJoined returns the values of the response header key of the
+// last request joined with sep.
+func (r *Rattle) ResponseHeaderJoined(key, sep string) string {
+  return strings.Join(r.ResponseHeaderAll(key), sep)
+}
+
+// AssertMinTLS returns an error unless the last response was served over
+// TLS version v or newer, e.g. tls.VersionTLS12.
+func (r *Rattle) AssertMinTLS(v uint16) error {
+  if r.resp == nil {
+    return fmt.Errorf("%s not defined", "response")
+  }
+  if r.resp.TLS == nil {
+    return fmt.Errorf("response not served over TLS")
+  }
+  if r.resp.TLS.Version < v {
+    return fmt.Errorf("TLS version %#04x below minimum %#04x", r.resp.TLS.Version, v)
+  }
+  return nil
+}
+
+// CookiesForURL returns the cookies the client's cookie jar would send
+// with a request to the current URL.
+func (r *Rattle) CookiesForURL() ([]*http.Cookie, error) {
+  if r.httpClient.Jar == nil {
+    return nil, fmt.Errorf("%s not defined", "cookie jar")
+  }
+  reqURL, err := url.Parse(r.rawURL)
+  if err != nil {
+    return nil, err
+  }
+  return r.httpClient.Jar.Cookies(reqURL), nil
+}
+
 // Send is shorthand for calling Rattle and Do.
 func (r *Rattle) Send() (result []byte, code int, err error) {
   var req *http.Request
@@ -311,30 +869,242 @@ func (r *Rattle) Send() (result []byte, code int, err error) {
   return
 }
 
-// Do sends an HTTP Request and returns the result. status code and error
-func (r *Rattle) Do(req *http.Request) ([]byte, int, error) {
-  resp, err := r.httpClient.Do(req)
-  if err != nil {
+// ErrPreconditionFailed is returned by Do, along with the response, for 412
+// Precondition Failed responses, e.g. when the entity tag of IfMatch is
+// outdated.
+var ErrPreconditionFailed = errors.New("412 Precondition Failed")
+
+// Do sends an HTTP Request and returns the result. status code and error.
+// Attempts accepted by WouldRetry are retried up to Config.RetryTimes times.
+func (r *Rattle) Do(req *http.Request) (result []byte, code int, err error) {
+  start := time.Now()
+  if r.config.SingleFlight && (req.Method == GET || req.Method == HEAD) {
+    result, code, err = r.doShared(req)
+  } else {
+    result, code, err = r.do(req)
+  }
+  if r.history != nil {
+    r.history.add(req, code, time.Since(start), err)
+  }
+  return
+}
+
+// DoWithContext is Do for req with the context ctx.
+func (r *Rattle) DoWithContext(ctx context.Context, req *http.Request) ([]byte, int, error) {
+  return r.Do(req.WithContext(ctx))
+}
+
+// flightResult is the result of a request shared by Config.SingleFlight
+type flightResult struct {
+  result []byte
+  code   int
+  resp   *http.Response
+  stats  Stats
+}
+
+// doShared sends req unless an identical request is already in flight, in
+// which case it waits for and shares that request's result.
+func (r *Rattle) doShared(req *http.Request) ([]byte, int, error) {
+  v, err, shared := r.flight.Do(req.Method+" "+req.URL.String(), func() (interface{}, error) {
+    result, code, err := r.do(req)
+    return flightResult{result: result, code: code, resp: r.resp, stats: r.stats}, err
+  })
+  res := v.(flightResult)
+  r.resp = res.resp
+  r.stats = res.stats
+  if shared && res.result != nil {
+    // every caller gets its own copy of the body
+    res.result = append([]byte{}, res.result...)
+  }
+  return res.result, res.code, err
+}
+
+func (r *Rattle) do(req *http.Request) ([]byte, int, error) {
+  start := time.Now()
+  r.stats = Stats{}
+  req, cancel := r.withTimeout(req)
+  defer cancel()
+  req = r.withBodyDeadline(req, start)
+  req, traced := r.traceStats(req)
+  req, release := r.hookConns(req)
+  defer release()
+  defer r.reportSlow(req)
+  resp, err := r.roundTrip(req, start)
+  traced()
+  if resp == nil {
+    r.stats.finish(start, 0)
     return nil, 0, err
   }
+  // a RetryError of the status, returned along with the body
+  failed := err
   defer func() {
     resp.Close = true
     _ = resp.Body.Close()
   }()
   r.resp = resp
+  if err = decompressResponse(resp); err != nil {
+    r.stats.finish(start, 0)
+    return nil, resp.StatusCode, err
+  }
 
-  //if resp.StatusCode >= 400 {
-  //	return nil, resp.StatusCode, fmt.Errorf("%s", resp.Status)
-  //}
+  // the body is returned for any status, error responses usually explain themselves
   res, err := ioutil.ReadAll(resp.Body)
+  r.stats.finish(start, len(res))
+  if err == nil {
+    err = failed
+  }
+  if err == nil && r.requireJSON && !isJSONResponse(resp) {
+    err = fmt.Errorf("response is not JSON: %s", resp.Header.Get(contentType))
+  }
+  if err == nil && r.checksum != nil {
+    err = r.checksum.verify(resp, res)
+  }
+  if err == nil && resp.StatusCode == http.StatusPreconditionFailed {
+    err = ErrPreconditionFailed
+  }
+  if err == nil {
+    err = r.checkLatency()
+  }
 
   return res, resp.StatusCode, err
 }
 
-// AddQuery add queries for GET request
+// roundTrip sends req, started at start, with the retries, Digest
+// authentication and Accept negotiation configured, and returns the final
+// response with its body unread. Idempotent requests failing because the
+// server closed the reused connection are sent once more on a new one,
+// whatever Config.RetryTimes. Hosts that failed to connect within
+// Config.HostFailureTTL fail at once. A request sent more than once that
+// fails in the end returns a RetryError, with the last response if that
+// failed by its status.
+func (r *Rattle) roundTrip(req *http.Request, start time.Time) (*http.Response, error) {
+  if r.hostFailures != nil {
+    if err := r.hostFailures.check(req.URL.Host); err != nil {
+      return nil, err
+    }
+  }
+  req, reused := traceReuse(req)
+  var (
+    resp     *http.Response
+    err      error
+    attempts int
+    failures []error
+  )
+  send := func() {
+    attempts++
+    resp, err = r.attempt(req)
+    if failure := r.attemptFailure(resp, err); failure != nil {
+      failures = append(failures, failure)
+    }
+  }
+  send()
+  if err != nil && reused() && isStaleConnErr(err) && isIdempotent(req) && resetBody(req) {
+    send()
+  }
+  var stopped error
+  for i := 0; i < r.config.RetryTimes && r.WouldRetry(resp, err); i++ {
+    wait := r.retryWait(resp, i)
+    if !r.withinRetryDeadline(start, wait) || !resetBody(req) {
+      break
+    }
+    discardResponse(resp)
+    if stopped = sleepContext(req.Context(), wait); stopped != nil {
+      resp = nil
+      break
+    }
+    r.stats.Retries++
+    send()
+  }
+  if err != nil {
+    resp = nil
+  }
+  if r.hostFailures != nil {
+    // only the last attempt tells whether the host is down now
+    r.hostFailures.report(req.URL.Host, err)
+  }
+  // the attempts before the last one all failed, or there were none
+  if attempts > 1 && len(failures) == attempts {
+    return resp, &RetryError{Attempts: attempts, Errors: failures, stopped: stopped}
+  }
+  if stopped != nil {
+    return nil, stopped
+  }
+  if err == nil && r.digest != nil {
+    resp, err = r.digest.retry(r.attempt, req, resp)
+  }
+  if err == nil && len(r.acceptTypes) > 1 {
+    resp, err = r.negotiate(req, resp)
+  }
+  return resp, err
+}
+
+// attempt sends req once, once Config.RateLimit allows it, recording how
+// long it took until the response headers arrived.
+func (r *Rattle) attempt(req *http.Request) (*http.Response, error) {
+  if r.limiter != nil {
+    if err := r.limiter.wait(req.Context()); err != nil {
+      return nil, err
+    }
+  }
+  start := time.Now()
+  var resp *http.Response
+  var err error
+  if r.proxies != nil {
+    resp, err = r.sendProxied(req)
+  } else {
+    resp, err = r.client().Do(req)
+  }
+  r.stats.LastAttemptTime = time.Since(start)
+  return resp, err
+}
+
+// AddQuery add queries for GET request. params is a url tagged struct, or
+// a url.Values, map[string][]string or map[string]string merged as is.
 func (r *Rattle) AddQuery(params interface{}) *Rattle {
   if params != nil {
     r.parameters = append(r.parameters, params)
   }
   return r
 }
+
+// binaryQuery is a query value of raw bytes
+type binaryQuery struct {
+  key  string
+  data []byte
+}
+
+// AddQueryBinary adds the query key with data encoded as unpadded base64url,
+// see https://tools.ietf.org/html/rfc4648#section-5
+func (r *Rattle) AddQueryBinary(key string, data []byte) *Rattle {
+  r.parameters = append(r.parameters, binaryQuery{key: key, data: data})
+  return r
+}
+
+// AddQueryJSON adds the members of the flat JSON object jsonStr as queries,
+// e.g. {"a":"1","b":2} adds a=1&b=2. Numbers and booleans are added as
+// written, null as an empty value. Nested objects and arrays are an error.
+func (r *Rattle) AddQueryJSON(jsonStr string) *Rattle {
+  decoder := json.NewDecoder(strings.NewReader(jsonStr))
+  decoder.UseNumber()
+  var members map[string]interface{}
+  if err := decoder.Decode(&members); err != nil {
+    return r.setErr(fmt.Errorf("query JSON: %v", err))
+  }
+  values := make(url.Values, len(members))
+  for key, member := range members {
+    switch v := member.(type) {
+    case string:
+      values.Set(key, v)
+    case json.Number:
+      values.Set(key, v.String())
+    case bool:
+      values.Set(key, strconv.FormatBool(v))
+    case nil:
+      values.Set(key, "")
+    default:
+      return r.setErr(fmt.Errorf("query JSON: %s is not a string, number, boolean or null", key))
+    }
+  }
+  r.parameters = append(r.parameters, values)
+  return r
+}
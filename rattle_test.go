@@ -17,8 +17,28 @@
 package rattle
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type TestParams struct {
@@ -120,3 +140,849 @@ func TestRequest_headers(t *testing.T) {
 		}
 	}
 }
+
+func TestBodyFunc(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set(contentType, req.Header.Get(contentType))
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	calls := 0
+	rattle := New().Post(ts.URL).BodyFunc(func() (io.Reader, string, error) {
+		calls++
+		return strings.NewReader(fmt.Sprintf("call-%d", calls)), "text/plain", nil
+	})
+	if calls != 0 {
+		t.Errorf("expected body func not to be called before send, got %d calls", calls)
+	}
+	for i := 1; i <= 2; i++ {
+		result, _, err := rattle.Send()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if expected := fmt.Sprintf("call-%d", i); string(result) != expected {
+			t.Errorf("expected body %s, got %s", expected, result)
+		}
+		if ct := rattle.GetResponse().Header.Get(contentType); ct != "text/plain" {
+			t.Errorf("expected content type text/plain, got %s", ct)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected body func to be called 2 times, got %d", calls)
+	}
+}
+
+func TestBodyFunc_retry(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body, _ = gzip.NewReader(req.Body)
+		}
+		received, _ := ioutil.ReadAll(body)
+		mu.Lock()
+		bodies = append(bodies, string(received))
+		mu.Unlock()
+		if atomic.AddInt32(&attempts, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	for _, compress := range []bool{false, true} {
+		bodies = nil
+		calls := 0
+		rattle := New(config).Post(ts.URL).BodyFunc(func() (io.Reader, string, error) {
+			calls++
+			// a body of another length on every call
+			return bytes.NewReader(bytes.Repeat([]byte("x"), calls)), "text/plain", nil
+		})
+		if compress {
+			rattle.CompressBodyIfLarger(0)
+		}
+		if _, code, err := rattle.Send(); err != nil || code != http.StatusOK {
+			t.Fatalf("unexpected result %d %v", code, err)
+		}
+		if expected := []string{"x", "xx"}; !reflect.DeepEqual(expected, bodies) || calls != 2 {
+			t.Errorf("compress %v: expected the func called again for the retry, got %q after %d calls", compress, bodies, calls)
+		}
+	}
+}
+
+func TestRequest_queryTimeFormat(t *testing.T) {
+	type timeParams struct {
+		Since time.Time  `url:"since"`
+		Until *time.Time `url:"until,omitempty"`
+	}
+	since := time.Date(2019, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	config := NewConfig()
+	config.QueryTimeFormat = "unix"
+	req, err := New(config).Get("http://example.com").AddQuery(timeParams{Since: since}).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "http://example.com?since=" + strconv.FormatInt(since.Unix(), 10)
+	if req.URL.String() != expected {
+		t.Errorf("expected url %s, got %s", expected, req.URL.String())
+	}
+
+	config = NewConfig()
+	config.QueryTimeFormat = "2006-01-02"
+	req, err = New(config).Get("http://example.com").AddQuery(timeParams{Since: since, Until: &since}).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = "http://example.com?since=2019-03-01&until=2019-03-01"
+	if req.URL.String() != expected {
+		t.Errorf("expected url %s, got %s", expected, req.URL.String())
+	}
+}
+
+func TestRequest_querySpaceAsPercent20(t *testing.T) {
+	query := map[string]string{"q": "rattle go", "op": "1+1"}
+	req, err := New().Get("http://example.com").AddQuery(query).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if expected := "op=1%2B1&q=rattle+go"; req.URL.RawQuery != expected {
+		t.Errorf("expected query %s, got %s", expected, req.URL.RawQuery)
+	}
+	req, err = New(&Config{}).Get("http://example.com").AddQuery(query).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if expected := "op=1%2B1&q=rattle+go"; req.URL.RawQuery != expected {
+		t.Errorf("expected query %s with a literal config, got %s", expected, req.URL.RawQuery)
+	}
+
+	config := NewConfig()
+	config.QuerySpaceAsPercent20 = true
+	req, err = New(config).Get("http://example.com").AddQuery(query).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if expected := "op=1%2B1&q=rattle%20go"; req.URL.RawQuery != expected {
+		t.Errorf("expected query %s, got %s", expected, req.URL.RawQuery)
+	}
+}
+
+func TestCookiesForURL(t *testing.T) {
+	rattle := New().Get("http://example.com/account/orders")
+	if _, err := rattle.CookiesForURL(); err == nil {
+		t.Errorf("expected error without cookie jar")
+	}
+
+	jar, _ := cookiejar.New(nil)
+	host, _ := url.Parse("http://example.com/account")
+	jar.SetCookies(host, []*http.Cookie{
+		{Name: "session", Value: "abc", Path: "/account"},
+		{Name: "theme", Value: "dark", Path: "/"},
+		{Name: "admin", Value: "1", Path: "/admin"},
+	})
+	rattle.httpClient.Jar = jar
+	cookies, err := rattle.CookiesForURL()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	got := make(map[string]string)
+	for _, c := range cookies {
+		got[c.Name] = c.Value
+	}
+	expected := map[string]string{"session": "abc", "theme": "dark"}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, got)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			return
+		}
+		cookie, err := req.Cookie("session")
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(cookie.Value))
+	}))
+	defer ts.Close()
+
+	if _, _, err := New().Get(ts.URL + "/login").Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, code, _ := New().Get(ts.URL + "/orders").Send(); code != http.StatusUnauthorized {
+		t.Errorf("expected no cookies kept without a jar, got %d", code)
+	}
+
+	jar, _ := cookiejar.New(nil)
+	parent := New(WithCookieJar(jar)).BaseURL(ts.URL)
+	if _, _, err := parent.Get("/login").Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	result, code, err := parent.New().Get("/orders").Send()
+	if err != nil || code != http.StatusOK || string(result) != "abc" {
+		t.Errorf("expected the session cookie sent by the child, got %d %q %v", code, result, err)
+	}
+}
+
+func TestResponseHeaderAll(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("X-Token", "first")
+		w.Header().Add("X-Token", "second")
+	}))
+	defer ts.Close()
+
+	rattle := New().Get(ts.URL)
+	if values := rattle.ResponseHeaderAll("X-Token"); values != nil {
+		t.Errorf("expected nil before a response, got %v", values)
+	}
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{"first", "second"}
+	if values := rattle.ResponseHeaderAll("x-token"); !reflect.DeepEqual(expected, values) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, values)
+	}
+	if joined := rattle.ResponseHeaderJoined("X-Token", ", "); joined != "first, second" {
+		t.Errorf("expected %q, got %q", "first, second", joined)
+	}
+	if joined := rattle.ResponseHeaderJoined("X-Missing", ", "); joined != "" {
+		t.Errorf("expected empty string, got %q", joined)
+	}
+}
+
+func TestConfig_redirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/old" {
+			http.Redirect(w, req, "/new", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("moved"))
+	}))
+	defer ts.Close()
+
+	result, code, err := New().Get(ts.URL + "/old").Send()
+	if err != nil || code != http.StatusOK || string(result) != "moved" {
+		t.Errorf("expected the redirect followed by default, got %d %q %v", code, result, err)
+	}
+	result, code, err = New(&Config{}).Get(ts.URL + "/old").Send()
+	if err != nil || code != http.StatusOK || string(result) != "moved" {
+		t.Errorf("expected the redirect followed with a literal config, got %d %q %v", code, result, err)
+	}
+
+	config := NewConfig()
+	config.DisableRedirects = true
+	rattle := New(config).Get(ts.URL + "/old")
+	if _, code, err = rattle.Send(); err != nil || code != http.StatusFound {
+		t.Fatalf("expected status 302, got %d %v", code, err)
+	}
+	if location := rattle.GetResponse().Header.Get("Location"); location != "/new" {
+		t.Errorf("expected Location /new, got %q", location)
+	}
+
+	var via int
+	config = NewConfig()
+	config.CheckRedirect = func(req *http.Request, v []*http.Request) error {
+		via = len(v)
+		return errors.New("no redirects to " + req.URL.Path)
+	}
+	if _, _, err = New(config).Get(ts.URL + "/old").Send(); err == nil || !strings.Contains(err.Error(), "no redirects to /new") {
+		t.Errorf("expected the error of CheckRedirect, got %v", err)
+	}
+	if via != 1 {
+		t.Errorf("expected CheckRedirect called with 1 previous request, got %d", via)
+	}
+}
+
+func TestConfig_TLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.InsecureSkipVerify = false
+	if _, _, err := New(config).Get(ts.URL).Send(); err == nil {
+		t.Errorf("expected error verifying a self-signed certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	config.TLSConfig = &tls.Config{RootCAs: pool}
+	if result, _, err := New(config).Get(ts.URL).Send(); err != nil || string(result) != "secure" {
+		t.Errorf("expected success with the server's certificate pool, got %q %v", result, err)
+	}
+
+	config = NewConfig()
+	config.InsecureSkipVerify = true
+	if result, _, err := New(config).Get(ts.URL).Send(); err != nil || string(result) != "secure" {
+		t.Errorf("expected success skipping verification, got %q %v", result, err)
+	}
+	// TLSConfig wins over InsecureSkipVerify
+	config.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	if _, _, err := New(config).Get(ts.URL).Send(); err == nil {
+		t.Errorf("expected error verifying against an empty certificate pool")
+	}
+
+	// the proxy is kept along the TLS configuration
+	config.UseProxy = true
+	config.ProxyHost = "http://127.0.0.1:1080"
+	config.MinTLSVersion = tls.VersionTLS13
+	transport := New(config).httpClient.Transport.(*http.Transport)
+	if transport.Proxy == nil {
+		t.Errorf("expected the proxy set")
+	}
+	if transport.TLSClientConfig == config.TLSConfig || transport.TLSClientConfig.RootCAs != config.TLSConfig.RootCAs {
+		t.Errorf("expected a copy of TLSConfig")
+	}
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected MinTLSVersion applied, got %#04x", transport.TLSClientConfig.MinVersion)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	client := New().BaseURL(ts.URL)
+	start := time.Now()
+	_, _, err := client.New().Get("/slow").Timeout(50 * time.Millisecond).Send()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("expected the timeout to fire before the server answers, took %v", elapsed)
+	}
+
+	// the timeout is limited to that request
+	if result, _, err := client.New().Get("/slow").Send(); err != nil || string(result) != "done" {
+		t.Errorf("expected the slow request to succeed without timeout, got %q %v", result, err)
+	}
+	if result, _, err := client.New().Get("/fast").Timeout(time.Second).Send(); err != nil || string(result) != "done" {
+		t.Errorf("expected the fast request to succeed within timeout, got %q %v", result, err)
+	}
+}
+
+func TestWithHardDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		// the body stalls after the headers
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	_, _, err := New().Get(ts.URL).WithHardDeadline(start.Add(100 * time.Millisecond)).Send()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("expected the deadline to abort the body read, took %v", elapsed)
+	}
+
+	// the earlier of the deadline and the timeout wins
+	start = time.Now()
+	_, _, err = New().Get(ts.URL).WithHardDeadline(start.Add(time.Minute)).Timeout(100 * time.Millisecond).Send()
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) >= 500*time.Millisecond {
+		t.Errorf("expected the timeout to abort the body read, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestAddHeader(t *testing.T) {
+	parent := New().Get("http://example.com").
+		SetHeaders(map[string]string{"x-request-id": "1", "Accept": "text/plain"}).
+		AddHeader("x-forwarded-for", "10.0.0.1").
+		AddHeader("X-Forwarded-For", "10.0.0.2")
+	child := parent.New().AddHeader("X-Forwarded-For", "10.0.0.3")
+	parent.AddHeader("X-Forwarded-For", "10.0.0.4")
+
+	req, err := parent.GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.4"}
+	if got := req.Header.Values("X-Forwarded-For"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, got)
+	}
+	if req.Header.Get("X-Request-Id") != "1" || req.Header.Get("Accept") != "text/plain" {
+		t.Errorf("expected the headers of SetHeaders, got %v", req.Header)
+	}
+
+	req, err = child.GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	if got := req.Header.Values("X-Forwarded-For"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, got)
+	}
+}
+
+func TestSetBearerToken(t *testing.T) {
+	parent := New().Get("http://example.com").SetBasicAuth("user", "secret").SetBearerToken("abc.def.ghi")
+	child := parent.New()
+	for _, rattle := range []*Rattle{parent, child} {
+		req, err := rattle.GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := []string{"Bearer abc.def.ghi"}
+		if got := req.Header.Values("Authorization"); !reflect.DeepEqual(expected, got) {
+			t.Errorf("not DeepEqual: expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	var received []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/final":
+			received, _ = ioutil.ReadAll(req.Body)
+			_, _ = w.Write([]byte("done"))
+		case "/moved":
+			http.Redirect(w, req, "/final", http.StatusTemporaryRedirect)
+		default:
+			http.Redirect(w, req, "/moved", http.StatusPermanentRedirect)
+		}
+	}))
+	defer ts.Close()
+
+	bodies := map[string]func() *Rattle{
+		"JSON": func() *Rattle { return New().Post(ts.URL+"/moved").BodyJSON(testItem{ID: 1}, false) },
+		// only seekable, so http.NewRequest can't replay it on its own
+		"seeker": func() *Rattle {
+			body := onlyReadSeeker{strings.NewReader(`{"id":1,"name":""}` + "\n")}
+			return New().Post(ts.URL + "/moved").BodyOriginal(body)
+		},
+	}
+	for name, rattle := range bodies {
+		received = nil
+		result, code, err := rattle().MaxRedirects(1).Send()
+		if err != nil || code != http.StatusOK || string(result) != "done" {
+			t.Fatalf("%s: expected the final response, got %d %q %v", name, code, result, err)
+		}
+		if expected := `{"id":1,"name":""}` + "\n"; string(received) != expected {
+			t.Errorf("%s: expected the body resent to the final endpoint, got %q", name, received)
+		}
+	}
+
+	if _, _, err := New().Post(ts.URL+"/start").BodyJSON(testItem{ID: 1}, false).MaxRedirects(1).Send(); err == nil {
+		t.Errorf("expected error after too many redirects")
+	}
+	if _, code, err := New().Post(ts.URL+"/start").BodyJSON(testItem{ID: 1}, false).MaxRedirects(2).Send(); err != nil || code != http.StatusOK {
+		t.Errorf("expected 2 redirects followed, got %d %v", code, err)
+	}
+}
+
+// roundTripperFunc adapts a function to a http.RoundTripper.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSetHTTPClient(t *testing.T) {
+	var requested []string
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusTeapot,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader("canned")),
+			Request:    req,
+		}, nil
+	})}
+
+	// the host doesn't resolve, any network access fails
+	cases := []*Rattle{
+		New().SetHTTPClient(client).Get("http://rattle.invalid/a"),
+		New(&Config{HTTPClient: client}).New().Get("http://rattle.invalid/b"),
+	}
+	for _, rattle := range cases {
+		result, code, err := rattle.Send()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if code != http.StatusTeapot || string(result) != "canned" {
+			t.Errorf("expected the canned response, got %d %q", code, result)
+		}
+	}
+	expected := []string{"http://rattle.invalid/a", "http://rattle.invalid/b"}
+	if !reflect.DeepEqual(expected, requested) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, requested)
+	}
+	if rattle := New().SetHTTPClient(nil); rattle.httpClient == nil {
+		t.Errorf("expected SetHTTPClient(nil) to keep the client")
+	}
+}
+
+func TestAddQuery_maps(t *testing.T) {
+	type paging struct {
+		Page  int `url:"page"`
+		Limit int `url:"limit"`
+	}
+	req, err := New().Get("http://example.com?sort=name").
+		AddQuery(paging{Page: 2, Limit: 50}).
+		AddQuery(map[string]string{"q": "rattle go"}).
+		AddQuery(map[string][]string{"tag": {"http", "client"}}).
+		AddQuery(url.Values{"tag": {"go"}, "sort": {"date"}}).
+		GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "limit=50&page=2&q=rattle+go&sort=name&sort=date&tag=http&tag=client&tag=go"
+	if req.URL.RawQuery != expected {
+		t.Errorf("expected query %s, got %s", expected, req.URL.RawQuery)
+	}
+}
+
+func TestAddQueryJSON(t *testing.T) {
+	req, err := New().Get("http://example.com?c=3").AddQueryJSON(`{"a":"1","b":2,"d":true,"e":null,"f":1.5e3}`).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "http://example.com?a=1&b=2&c=3&d=true&e=&f=1.5e3"
+	if req.URL.String() != expected {
+		t.Errorf("expected url %s, got %s", expected, req.URL.String())
+	}
+
+	cases := map[string]string{
+		`{"a":{"b":1}}`: "query JSON: a is not a string, number, boolean or null",
+		`{"a":[1,2]}`:   "query JSON: a is not a string, number, boolean or null",
+		`[1,2]`:         "query JSON: json: cannot unmarshal array",
+	}
+	for jsonStr, message := range cases {
+		_, err := New().Get("http://example.com").AddQueryJSON(jsonStr).GetRequest()
+		if err == nil || !strings.HasPrefix(err.Error(), message) {
+			t.Errorf("%s: expected error %q, got %v", jsonStr, message, err)
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	const current = `"v2"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-Match") != current {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_, _ = w.Write([]byte("stale"))
+			return
+		}
+		_, _ = w.Write([]byte("updated"))
+	}))
+	defer ts.Close()
+
+	for _, etag := range []string{`"v2"`, "v2"} {
+		result, code, err := New().Put(ts.URL).IfMatch(etag).BodyJSON("doc", false).Send()
+		if err != nil || code != http.StatusOK || string(result) != "updated" {
+			t.Errorf("%s: expected the update applied, got %d %q %v", etag, code, result, err)
+		}
+	}
+
+	result, code, err := New().Put(ts.URL).IfMatch(`"v1"`).BodyJSON("doc", false).Send()
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed, got %v", err)
+	}
+	if code != http.StatusPreconditionFailed || string(result) != "stale" {
+		t.Errorf("expected the 412 response along the error, got %d %q", code, result)
+	}
+
+	req, _ := New().Put(ts.URL).IfMatch(`W/"v1"`).GetRequest()
+	if got := req.Header.Get("If-Match"); got != `W/"v1"` {
+		t.Errorf("expected weak tag kept, got %s", got)
+	}
+}
+
+func TestMultipartBoundary(t *testing.T) {
+	file := bodyProviderFileStruct{fileName: "a.txt", fieldName: "file", file: strings.NewReader("content")}
+	cases := []*Rattle{
+		New().Post("http://example.com").MultipartBoundary("rattle-boundary").BodyFile(nil, file),
+		New().Post("http://example.com").BodyFile(nil, file).MultipartBoundary("rattle-boundary"),
+	}
+	for _, c := range cases {
+		req, err := c.GetRequest()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if ct := req.Header.Get(contentType); ct != "multipart/form-data; boundary=rattle-boundary" {
+			t.Errorf("expected boundary in content type, got %s", ct)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if !strings.HasPrefix(string(body), "--rattle-boundary\r\n") {
+			t.Errorf("expected body to start with the boundary, got %q", body)
+		}
+	}
+
+	_, err := New().Post("http://example.com").MultipartBoundary("bad boundary!\n").BodyFile(nil, file).GetRequest()
+	if err == nil {
+		t.Errorf("expected error for invalid boundary")
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	rattle := New().Get(ts.URL)
+	if err := rattle.AssertMinTLS(tls.VersionTLS12); err == nil {
+		t.Errorf("expected error before any response")
+	}
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := rattle.AssertMinTLS(tls.VersionTLS12); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := rattle.AssertMinTLS(tls.VersionTLS13); err == nil {
+		t.Errorf("expected TLS 1.2 response to fail a TLS 1.3 minimum")
+	}
+
+	config := NewConfig()
+	config.MinTLSVersion = tls.VersionTLS13
+	if _, _, err := New(config).Get(ts.URL).Send(); err == nil {
+		t.Errorf("expected handshake with a TLS 1.2 server to fail")
+	}
+}
+
+func TestNew_options(t *testing.T) {
+	rattle := New(WithConnectTimeout(time.Second), WithHeaderTimeout(2*time.Second), WithRetries(3))
+	if rattle.config.HTTPTimeout.ConnectTimeout != time.Second {
+		t.Errorf("expected connect timeout %v, got %v", time.Second, rattle.config.HTTPTimeout.ConnectTimeout)
+	}
+	if rattle.config.HTTPTimeout.HeaderTimeout != 2*time.Second {
+		t.Errorf("expected header timeout %v, got %v", 2*time.Second, rattle.config.HTTPTimeout.HeaderTimeout)
+	}
+	if rattle.config.RetryTimes != 3 {
+		t.Errorf("expected %d retries, got %d", 3, rattle.config.RetryTimes)
+	}
+	// untouched values keep their defaults
+	if rattle.config.HTTPTimeout.ReadTimeout != NewConfig().HTTPTimeout.ReadTimeout {
+		t.Errorf("expected default read timeout, got %v", rattle.config.HTTPTimeout.ReadTimeout)
+	}
+
+	config := NewConfig()
+	config.UseProxy = true
+	config.RetryTimes = 1
+	rattle = New(config, WithRetries(5))
+	if !rattle.config.UseProxy || rattle.config.RetryTimes != 5 {
+		t.Errorf("expected options to apply on top of the config, got %+v", rattle.config)
+	}
+	if config.RetryTimes != 1 {
+		t.Errorf("options must not modify the passed config")
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("shared"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.SingleFlight = true
+	base := New(config).Get(ts.URL)
+	start := make(chan struct{})
+	results := make(chan string, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rattle := base.New()
+			<-start
+			result, code, err := rattle.Send()
+			if err != nil || code != http.StatusOK {
+				t.Errorf("unexpected result %d %v", code, err)
+			}
+			results <- string(result)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected the server to see 1 request, got %d", n)
+	}
+	for result := range results {
+		if result != "shared" {
+			t.Errorf("expected body shared, got %s", result)
+		}
+	}
+}
+
+func TestAddQueryBinary(t *testing.T) {
+	data := []byte{0xfb, 0xff, 0x00, 0x10, 0x3e}
+	req, err := New().Get("http://example.com").AddQuery(params).AddQueryBinary("sig", data).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "http://example.com?count=25&name=recent&sig=-_8AED4"
+	if req.URL.String() != expected {
+		t.Errorf("expected url %s, got %s", expected, req.URL.String())
+	}
+	if decoded, _ := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("sig")); !reflect.DeepEqual(data, decoded) {
+		t.Errorf("expected decoded %v, got %v", data, decoded)
+	}
+}
+
+func TestNew_config(t *testing.T) {
+	// a closed listener leaves a port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	deadURL := "http://" + l.Addr().String()
+	_ = l.Close()
+
+	rattle := New(&Config{RetryTimes: 3, ReUseTCP: true}).Get(deadURL)
+	if child := rattle.New(); child.config.RetryTimes != 3 || !child.config.ReUseTCP {
+		t.Errorf("expected child to inherit the config, got %+v", child.config)
+	}
+	req, err := rattle.GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if req.Close {
+		t.Errorf("expected req.Close false with ReUseTCP")
+	}
+	var connects int32
+	transport := rattle.httpClient.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&connects, 1)
+		return dial(ctx, network, addr)
+	}
+	if _, _, err = rattle.Do(req); err == nil {
+		t.Errorf("expected connection error")
+	}
+	if n := atomic.LoadInt32(&connects); n != 4 {
+		t.Errorf("expected 1 attempt and 3 retries, got %d attempts", n)
+	}
+
+	// the zero values of a literal config must not break requests
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	if result, _, err := New(&Config{}).Get(ts.URL).Send(); err != nil || string(result) != "ok" {
+		t.Errorf("expected ok, got %s %v", result, err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := New(config).Get(ts.URL).WithContext(ctx).Send()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the request to be cancelled without retries, took %v", elapsed)
+	}
+
+	rattle := New().Get(ts.URL)
+	req, _ := rattle.GetRequest()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err = rattle.DoWithContext(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	rattle := New().BaseURL("HTTPS://API.Example.COM/v1/Users/")
+	if err := rattle.Err(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rattle.rawURL != "https://api.example.com/v1/Users/" {
+		t.Errorf("expected scheme and host lowercased, got %s", rattle.rawURL)
+	}
+
+	for _, rawURL := range []string{"://example.com", "http://[::1", "example.com/path", "/relative"} {
+		rattle = New().BaseURL(rawURL)
+		if rattle.Err() == nil {
+			t.Errorf("expected error for base URL %q", rawURL)
+		}
+		if _, _, err := rattle.Get("items").Send(); err != rattle.Err() {
+			t.Errorf("expected Send to return %v, got %v", rattle.Err(), err)
+		}
+	}
+
+	// a valid base URL replaces an invalid one, but not other errors
+	rattle = New().BaseURL("/relative").BaseURL("http://example.com/")
+	if err := rattle.Err(); err != nil {
+		t.Errorf("expected the error of the replaced base URL cleared, got %v", err)
+	}
+	rattle = New().BaseURL("/relative").BaseURL("example.com/path")
+	if err := rattle.Err(); err == nil || !strings.Contains(err.Error(), "example.com/path") {
+		t.Errorf("expected the error of the last base URL, got %v", err)
+	}
+	rattle = New().UploadChunked("upload.txt", 0, nil).BaseURL("http://example.com/")
+	if rattle.Err() == nil {
+		t.Errorf("expected the errors of other methods kept")
+	}
+}
+
+func TestSend_errorBody(t *testing.T) {
+	const errorBody = `{"error":"invalid_request","message":"name is required"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(contentType, contentTypeJson)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(errorBody))
+	}))
+	defer ts.Close()
+
+	rattle := New().Post(ts.URL)
+	result, code, err := rattle.Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, code)
+	}
+	if string(result) != errorBody {
+		t.Errorf("expected error body %s, got %s", errorBody, result)
+	}
+	if rattle.GetResponse().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected response with status %d, got %d", http.StatusBadRequest, rattle.GetResponse().StatusCode)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// ReceiveJSON sends the request and decodes the JSON response body into
+// success if the status is < 400. Unlike Receive it ignores Config.Decoders,
+// any other Content-Type than JSON is an error.
+func (r *Rattle) ReceiveJSON(success interface{}) (int, error) {
+	return r.receive(success, nil, func(body []byte, v interface{}) error {
+		return decodeJSON(r.resp, body, v)
+	})
+}
+
+// Receive sends the request and decodes the JSON response body into success
+// if the status is < 400, or into failure otherwise, e.g. an error envelope
+// of a 422. Either may be nil to skip decoding. Empty bodies are not decoded.
+// Bodies with a Content-Type in Config.Decoders are decoded by its decoder,
+// any other Content-Type than JSON is an error. Responses with status >= 400
+// always return an error, besides the decoded failure.
+func (r *Rattle) Receive(success, failure interface{}) (int, error) {
+	return r.receive(success, failure, r.decode)
+}
+
+// receive sends the request and decodes the response body with decode, into
+// success or failure depending on the status.
+func (r *Rattle) receive(success, failure interface{}, decode func(body []byte, v interface{}) error) (int, error) {
+	result, code, err := r.Send()
+	if err != nil {
+		return code, err
+	}
+	if code >= 400 {
+		if err = decode(result, failure); err != nil {
+			return code, fmt.Errorf("%s: %v", r.resp.Status, err)
+		}
+		return code, fmt.Errorf("%s", r.resp.Status)
+	}
+	return code, decode(result, success)
+}
+
+// decode decodes body, the body of the last response, into v with the
+// decoder of its Content-Type in Config.Decoders, or as JSON.
+func (r *Rattle) decode(body []byte, v interface{}) error {
+	if v == nil || len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.resp.Header.Get(contentType)); err == nil {
+		if decoder, ok := r.config.Decoders[mediaType]; ok {
+			return decoder(bytes.NewReader(body), v)
+		}
+	}
+	return decodeJSON(r.resp, body, v)
+}
+
+// decodeJSON decodes the body of resp into v, unless v is nil or the body empty.
+func decodeJSON(resp *http.Response, body []byte, v interface{}) error {
+	if v == nil || len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if resp.Header.Get(contentType) != "" && !isJSONResponse(resp) {
+		return fmt.Errorf("response is not JSON: %s", resp.Header.Get(contentType))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ReceiveNDJSON sends the request and decodes a newline-delimited JSON
+// response into the slice pointed to by target, one element per line.
+// Blank lines are skipped. Responses with status >= 400 are not decoded.
+func (r *Rattle) ReceiveNDJSON(target interface{}) (int, error) {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return 0, fmt.Errorf("target must be a pointer to a slice, got %T", target)
+	}
+	result, code, err := r.Send()
+	if err != nil {
+		return code, err
+	}
+	if code >= 400 {
+		return code, fmt.Errorf("%s", r.resp.Status)
+	}
+
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	for _, line := range bytes.Split(result, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		elem := reflect.New(elemType)
+		if err = json.Unmarshal(line, elem.Interface()); err != nil {
+			return code, err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	v.Elem().Set(slice)
+	return code, nil
+}
+
+// ReceiveProto sends the request and unmarshals the protobuf response body
+// into msg. Responses with status >= 400 are not decoded.
+func (r *Rattle) ReceiveProto(msg proto.Message) (int, error) {
+	result, code, err := r.Send()
+	if err != nil {
+		return code, err
+	}
+	if code >= 400 {
+		return code, fmt.Errorf("%s", r.resp.Status)
+	}
+	return code, proto.Unmarshal(result, msg)
+}
+
+// ReceiveMsgPack sends the request and decodes the MessagePack response body
+// into v. Responses with status >= 400 are not decoded.
+func (r *Rattle) ReceiveMsgPack(v interface{}) (int, error) {
+	result, code, err := r.Send()
+	if err != nil {
+		return code, err
+	}
+	if code >= 400 {
+		return code, fmt.Errorf("%s", r.resp.Status)
+	}
+	return code, msgpack.Unmarshal(result, v)
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestReceiveNDJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(contentType, "application/x-ndjson")
+		_, _ = w.Write([]byte("{\"id\":1,\"name\":\"a\"}\n{\"id\":2,\"name\":\"b\"}\r\n{\"id\":3,\"name\":\"c\"}\n\n\n"))
+	}))
+	defer ts.Close()
+
+	var items []testItem
+	code, err := New().Get(ts.URL).ReceiveNDJSON(&items)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	expected := []testItem{{1, "a"}, {2, "b"}, {3, "c"}}
+	if !reflect.DeepEqual(expected, items) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, items)
+	}
+
+	if _, err = New().Get(ts.URL).ReceiveNDJSON(items); err == nil {
+		t.Errorf("expected error for non-pointer target")
+	}
+}
+
+func TestReceiveProto(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get(contentType); ct != contentTypeProtobuf {
+			t.Errorf("expected content type %s, got %s", contentTypeProtobuf, ct)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		in := &wrapperspb.StringValue{}
+		if err := proto.Unmarshal(body, in); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		out, _ := proto.Marshal(wrapperspb.String("echo: " + in.GetValue()))
+		w.Header().Set(contentType, contentTypeProtobuf)
+		_, _ = w.Write(out)
+	}))
+	defer ts.Close()
+
+	msg := &wrapperspb.StringValue{}
+	code, err := New().Post(ts.URL).BodyProto(wrapperspb.String("rattle")).ReceiveProto(msg)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if msg.GetValue() != "echo: rattle" {
+		t.Errorf("expected echo: rattle, got %s", msg.GetValue())
+	}
+}
+
+func TestReceiveMsgPack(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get(contentType); ct != contentTypeMsgPack {
+			t.Errorf("expected content type %s, got %s", contentTypeMsgPack, ct)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		var in testItem
+		if err := msgpack.Unmarshal(body, &in); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		in.ID++
+		out, _ := msgpack.Marshal(in)
+		w.Header().Set(contentType, contentTypeMsgPack)
+		_, _ = w.Write(out)
+	}))
+	defer ts.Close()
+
+	var item testItem
+	code, err := New().Post(ts.URL).BodyMsgPack(testItem{ID: 1, Name: "rattle"}).ReceiveMsgPack(&item)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	expected := testItem{ID: 2, Name: "rattle"}
+	if item != expected {
+		t.Errorf("expected %+v, got %+v", expected, item)
+	}
+}
+
+type testError struct {
+	Message string   `json:"message"`
+	Fields  []string `json:"fields"`
+}
+
+func TestReceive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+			w.Header().Set(contentType, "application/json; charset=utf-8")
+			_, _ = w.Write([]byte(`{"id":1,"name":"a"}`))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/html":
+			w.Header().Set(contentType, "text/html")
+			_, _ = w.Write([]byte("<html></html>"))
+		case "/invalid":
+			w.Header().Set(contentType, "application/problem+json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"message":"invalid","fields":["name"]}`))
+		}
+	}))
+	defer ts.Close()
+
+	var item testItem
+	code, err := New().Get(ts.URL + "/ok").ReceiveJSON(&item)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("unexpected result %d %v", code, err)
+	}
+	if item != (testItem{1, "a"}) {
+		t.Errorf("expected decoded item, got %+v", item)
+	}
+
+	item = testItem{}
+	if code, err = New().Get(ts.URL + "/empty").ReceiveJSON(&item); err != nil || code != http.StatusNoContent {
+		t.Errorf("expected empty body to be skipped, got %d %v", code, err)
+	}
+	if _, err = New().Get(ts.URL + "/html").ReceiveJSON(&item); err == nil {
+		t.Errorf("expected error for non JSON content type")
+	}
+
+	var failure testError
+	code, err = New().Get(ts.URL+"/invalid").Receive(&item, &failure)
+	if err == nil || code != http.StatusUnprocessableEntity {
+		t.Errorf("expected error with status 422, got %d %v", code, err)
+	}
+	expected := testError{Message: "invalid", Fields: []string{"name"}}
+	if !reflect.DeepEqual(expected, failure) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, failure)
+	}
+	if item != (testItem{}) {
+		t.Errorf("expected success not to be decoded on failure, got %+v", item)
+	}
+}
+
+// decodeFlatYAML decodes a YAML mapping of scalars, e.g. "name: rattle",
+// into a *map[string]string.
+func decodeFlatYAML(body io.Reader, v interface{}) error {
+	m, ok := v.(*map[string]string)
+	if !ok {
+		return fmt.Errorf("can't decode YAML into %T", v)
+	}
+	*m = map[string]string{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid YAML line %q", line)
+		}
+		(*m)[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+	return scanner.Err()
+}
+
+func TestReceive_decoders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/yaml":
+			w.Header().Set(contentType, "application/yaml; charset=utf-8")
+			_, _ = w.Write([]byte("---\nname: rattle\nlanguage: \"go\"\n"))
+		case "/json":
+			w.Header().Set(contentType, "application/json")
+			_, _ = w.Write([]byte(`{"name":"rattle"}`))
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.Decoders = map[string]func(io.Reader, interface{}) error{
+		"application/yaml": decodeFlatYAML,
+	}
+	var doc map[string]string
+	if _, err := New(config).Get(ts.URL+"/yaml").Receive(&doc, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := map[string]string{"name": "rattle", "language": "go"}
+	if !reflect.DeepEqual(expected, doc) {
+		t.Errorf("not DeepEqual: expected %v, got %v", expected, doc)
+	}
+
+	doc = nil
+	if _, err := New(config).Get(ts.URL+"/json").Receive(&doc, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if doc["name"] != "rattle" {
+		t.Errorf("expected JSON still decoded, got %v", doc)
+	}
+
+	if _, err := New().Get(ts.URL+"/yaml").Receive(&doc, nil); err == nil {
+		t.Errorf("expected error for YAML without decoder")
+	}
+	// ReceiveJSON only decodes JSON
+	if _, err := New(config).Get(ts.URL + "/yaml").ReceiveJSON(&doc); err == nil {
+		t.Errorf("expected error for YAML with ReceiveJSON")
+	}
+}
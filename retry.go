@@ -0,0 +1,274 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// WouldRetry reports whether the configured retry policy would retry an
+// attempt that ended with resp and err. Nothing is sent, so it can be used
+// to drive custom retry loops.
+func (r *Rattle) WouldRetry(resp *http.Response, err error) bool {
+	if r.config.RetryTimes <= 0 {
+		return false
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		if len(r.config.RetryErrorSubstrings) == 0 {
+			return true
+		}
+		for _, substr := range r.config.RetryErrorSubstrings {
+			if strings.Contains(err.Error(), substr) {
+				return true
+			}
+		}
+		return false
+	}
+	if resp == nil {
+		return false
+	}
+	if r.requireJSON && !isJSONResponse(resp) {
+		return true
+	}
+	for _, code := range r.config.RetryStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryError is returned by Do when a request sent more than once failed in
+// the end, with the failure of each attempt: its error, or its status for
+// responses that would be retried. With a failed status the body of the last
+// response is returned too.
+type RetryError struct {
+	Attempts int
+	Errors   []error
+	// error that stopped the retries early, e.g. the context ending while
+	// waiting for the next attempt, nil if none
+	stopped error
+}
+
+func (e *RetryError) Error() string {
+	msg := fmt.Sprintf("%d attempts failed, last: %v", e.Attempts, e.Errors[len(e.Errors)-1])
+	if e.stopped != nil {
+		msg += fmt.Sprintf(", stopped: %v", e.stopped)
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the attempts, and the error that stopped the
+// retries, so errors.Is and errors.As match any of them.
+func (e *RetryError) Unwrap() []error {
+	if e.stopped != nil {
+		return append(append([]error{}, e.Errors...), e.stopped)
+	}
+	return e.Errors
+}
+
+// attemptFailure returns the failure of an attempt that ended with resp and
+// err, or nil if it didn't fail: err, or the status of a response the retry
+// policy would retry.
+func (r *Rattle) attemptFailure(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp != nil && r.WouldRetry(resp, nil) {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// withinRetryDeadline reports whether another attempt, after waiting wait,
+// still starts within Config.RetryDeadline of start.
+func (r *Rattle) withinRetryDeadline(start time.Time, wait time.Duration) bool {
+	if r.config.RetryDeadline <= 0 {
+		return true
+	}
+	return time.Since(start)+wait < r.config.RetryDeadline
+}
+
+// retryWait returns how long to wait before the retry following attempt,
+// counted from 0, which ended with resp. The Retry-After header of 429 and
+// 503 responses wins over the backoff, capped at RetryMaxInterval like it.
+// A wait past RetryDeadline ends the retries, see withinRetryDeadline.
+func (r *Rattle) retryWait(resp *http.Response, attempt int) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if max := r.config.RetryMaxInterval; max > 0 && wait > max {
+				wait = max
+			}
+			return wait
+		}
+	}
+	return r.config.backoff(attempt)
+}
+
+// backoff returns the wait before the retry following attempt: RetryInterval
+// grown by RetryBackoff per attempt, capped at RetryMaxInterval and spread
+// by RetryJitter.
+func (c *Config) backoff(attempt int) time.Duration {
+	wait := float64(c.RetryInterval)
+	if c.RetryBackoff > 1 {
+		wait *= math.Pow(c.RetryBackoff, float64(attempt))
+	}
+	if c.RetryMaxInterval > 0 && wait > float64(c.RetryMaxInterval) {
+		wait = float64(c.RetryMaxInterval)
+	}
+	if c.RetryJitter > 0 {
+		wait *= 1 + c.RetryJitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(wait)
+}
+
+// parseRetryAfter parses a Retry-After value, either in seconds or an
+// HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := time.Until(date); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// sleepContext waits for d, or returns the error of ctx if it ends first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RequireJSONOrRetry makes responses that aren't JSON, e.g. an HTML error
+// page of a proxy, retryable failures. They are retried up to
+// Config.RetryTimes times, and if the last one still isn't JSON, Do returns
+// its body together with an error.
+func (r *Rattle) RequireJSONOrRetry() *Rattle {
+	r.requireJSON = true
+	return r
+}
+
+// isJSONResponse reports whether resp has a JSON Content-Type, like
+// application/json or application/problem+json.
+func isJSONResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get(contentType))
+	if err != nil {
+		return false
+	}
+	return mediaType == contentTypeJson || strings.HasSuffix(mediaType, "+json")
+}
+
+// resetBody rewinds the request body before it is sent again. It returns
+// false if the body has been consumed and can't be regenerated.
+func resetBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// discardResponse drains and closes the body of a response that is going
+// to be retried, so its connection can be reused.
+func discardResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// traceReuse returns req reporting whether its last attempt was sent on a
+// reused connection.
+func traceReuse(req *http.Request) (*http.Request, func() bool) {
+	var reused int32
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.StoreInt32(&reused, 1)
+			} else {
+				atomic.StoreInt32(&reused, 0)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return req, func() bool {
+		return atomic.LoadInt32(&reused) == 1
+	}
+}
+
+// isStaleConnErr reports whether err tells the server closed the connection,
+// as it does with keep-alive connections idle for too long.
+func isStaleConnErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}
+
+// isIdempotent reports whether req may be sent twice without side effects.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case GET, HEAD, OPTIONS, PUT, DELETE, http.MethodTrace:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
@@ -0,0 +1,633 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWouldRetry(t *testing.T) {
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	withCodes := New(config)
+	withoutCodes := New()
+
+	cases := []struct {
+		rattle   *Rattle
+		status   int
+		expected bool
+	}{
+		{withCodes, http.StatusServiceUnavailable, true},
+		{withCodes, http.StatusOK, false},
+		{withCodes, http.StatusInternalServerError, false},
+		{withoutCodes, http.StatusServiceUnavailable, false},
+	}
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status}
+		if got := c.rattle.WouldRetry(resp, nil); got != c.expected {
+			t.Errorf("expected WouldRetry %v for status %d, got %v", c.expected, c.status, got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("recovered"))
+	}))
+	defer ts.Close()
+
+	// without RetryTimes a request is sent once, as before
+	if _, code, _ := New().Get(ts.URL).Send(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the 503 returned, got %d", code)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	result, code, err := New(config).Get(ts.URL).Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK || string(result) != "recovered" {
+		t.Errorf("expected the retried response, got %d %q", code, result)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+// stallListener holds the first stall accepted connections without serving
+// them, so the client's TLS handshake on them never completes.
+type stallListener struct {
+	net.Listener
+	mu      sync.Mutex
+	stall   int
+	stalled []net.Conn
+}
+
+func (l *stallListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		if l.stall == 0 {
+			l.mu.Unlock()
+			return conn, nil
+		}
+		l.stall--
+		l.stalled = append(l.stalled, conn)
+		l.mu.Unlock()
+	}
+}
+
+func (l *stallListener) setStall(n int) {
+	l.mu.Lock()
+	l.stall = n
+	l.mu.Unlock()
+}
+
+func (l *stallListener) stalledConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.stalled)
+}
+
+func (l *stallListener) Close() error {
+	l.mu.Lock()
+	for _, conn := range l.stalled {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+func TestRetry_tlsHandshakeTimeout(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	listener := &stallListener{Listener: ts.Listener, stall: 1}
+	ts.Listener = listener
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := NewConfig()
+	config.TLSHandshakeTimeout = 50 * time.Millisecond
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	result, code, err := New(config).Get(ts.URL).Send()
+	if err != nil {
+		t.Fatalf("expected the handshake timeout to be retried, got %v", err)
+	}
+	if code != http.StatusOK || string(result) != "ok" {
+		t.Errorf("expected 200 ok, got %d %s", code, result)
+	}
+	if n := listener.stalledConns(); n != 1 {
+		t.Errorf("expected 1 stalled connection, got %d", n)
+	}
+
+	config.RetryTimes = 0
+	listener.setStall(1)
+	if _, _, err = New(config).Get(ts.URL).Send(); err == nil || !strings.Contains(err.Error(), "TLS handshake timeout") {
+		t.Errorf("expected TLS handshake timeout without retries, got %v", err)
+	}
+}
+
+func TestRequireJSONOrRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set(contentType, "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<html>Bad Gateway</html>"))
+			return
+		}
+		w.Header().Set(contentType, "application/json; charset=utf-8")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryInterval = time.Millisecond
+	result, _, err := New(config).Get(ts.URL).RequireJSONOrRetry().Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(result) != `{"ok":true}` {
+		t.Errorf("expected the JSON response, got %s", result)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	config.RetryTimes = 0
+	result, _, err = New(config).Get(ts.URL).RequireJSONOrRetry().Send()
+	if err == nil {
+		t.Errorf("expected error for a non JSON response")
+	}
+	if !strings.Contains(string(result), "Bad Gateway") {
+		t.Errorf("expected the HTML body to be returned, got %s", result)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 10
+	config.RetryInterval = 20 * time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	config.RetryDeadline = 70 * time.Millisecond
+	start := time.Now()
+	_, code, err := New(config).Get(ts.URL).Send()
+	retryErr, ok := err.(*RetryError)
+	if !ok {
+		t.Fatalf("expected *RetryError, got %v", err)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if n := atomic.LoadInt32(&requests); n < 2 || n > 4 || retryErr.Attempts != int(n) {
+		t.Errorf("expected the deadline to stop after 2 to 4 attempts, got %d, %d in the error", n, retryErr.Attempts)
+	}
+	if elapsed := time.Since(start); elapsed > config.RetryDeadline {
+		t.Errorf("expected retries to end within %v, took %v", config.RetryDeadline, elapsed)
+	}
+}
+
+// onlyReader hides all methods but Read, so http.NewRequest can't replay it.
+type onlyReader struct {
+	io.Reader
+}
+
+// onlyReadSeeker hides all methods but Read and Seek.
+type onlyReadSeeker struct {
+	io.ReadSeeker
+}
+
+func TestRetry_body(t *testing.T) {
+	var attempts int32
+	var bodies []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if atomic.AddInt32(&attempts, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	const payload = "the full intended body"
+	cases := map[string]*Rattle{
+		"func": New(config).Post(ts.URL).BodyFunc(func() (io.Reader, string, error) {
+			return onlyReader{strings.NewReader(payload)}, "text/plain", nil
+		}),
+		"json":   New(config).Post(ts.URL).BodyJSON(payload, true),
+		"seeker": New(config).Post(ts.URL).BodyOriginal(onlyReadSeeker{strings.NewReader(payload)}),
+	}
+	for name, rattle := range cases {
+		atomic.StoreInt32(&attempts, 0)
+		bodies = nil
+		result, code, err := rattle.Send()
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if code != http.StatusOK || !strings.Contains(string(result), payload) {
+			t.Errorf("%s: expected the full body after retries, got %d %q", name, code, result)
+		}
+		if len(bodies) != 3 || bodies[0] != bodies[1] || bodies[1] != bodies[2] {
+			t.Errorf("%s: expected 3 attempts with the same body, got %q", name, bodies)
+		}
+	}
+
+	// a body that can't be replayed is not retried with an empty body
+	atomic.StoreInt32(&attempts, 0)
+	bodies = nil
+	_, code, err := New(config).Post(ts.URL).BodyOriginal(onlyReader{strings.NewReader(payload)}).Send()
+	if err != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("expected the first response without retry, got %d %v", code, err)
+	}
+	if len(bodies) != 1 || bodies[0] != payload {
+		t.Errorf("expected 1 attempt with the full body, got %q", bodies)
+	}
+}
+
+func TestRetry_retryAfter(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("recovered"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 3
+	config.RetryInterval = time.Minute
+	config.RetryStatusCodes = []int{429, 500, 502, 503, 504}
+	start := time.Now()
+	result, code, err := New(config).Get(ts.URL).Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK || string(result) != "recovered" {
+		t.Errorf("expected the final body, got %d %q", code, result)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected Retry-After to replace RetryInterval, took %v", elapsed)
+	}
+}
+
+func TestRetry_retryAfterLimits(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("recovered"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryMaxInterval = 10 * time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusTooManyRequests}
+	start := time.Now()
+	result, code, err := New(config).Get(ts.URL).Send()
+	if err != nil || code != http.StatusOK || string(result) != "recovered" {
+		t.Fatalf("unexpected result %d %q %v", code, result, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected Retry-After capped at RetryMaxInterval, took %v", elapsed)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	config = NewConfig()
+	config.RetryTimes = 1
+	config.RetryDeadline = time.Second
+	config.RetryStatusCodes = []int{http.StatusTooManyRequests}
+	start = time.Now()
+	if _, code, _ = New(config).Get(ts.URL).Send(); code != http.StatusTooManyRequests {
+		t.Errorf("expected the 429 returned, got %d", code)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected no retry after a Retry-After past RetryDeadline, got %d attempts", n)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected no wait for Retry-After past RetryDeadline, took %v", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, c := range cases {
+		wait, ok := parseRetryAfter(c.value)
+		if wait != c.wait || ok != c.ok {
+			t.Errorf("parseRetryAfter(%q) = %v %v, expected %v %v", c.value, wait, ok, c.wait, c.ok)
+		}
+	}
+	wait, ok := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if !ok || wait <= 58*time.Minute || wait > time.Hour {
+		t.Errorf("expected about an hour for a date, got %v %v", wait, ok)
+	}
+}
+
+func TestRetry_backoff(t *testing.T) {
+	var mu sync.Mutex
+	var stamps []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		stamps = append(stamps, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryStatusCodes = []int{http.StatusBadGateway}
+	_, code, err := New(config, WithRetries(3), WithRetryBackoff(20*time.Millisecond, 3, time.Second, 0)).Get(ts.URL).Send()
+	if _, ok := err.(*RetryError); !ok || code != http.StatusBadGateway {
+		t.Fatalf("expected the last 502 with a RetryError, got %d %v", code, err)
+	}
+	if len(stamps) != 4 {
+		t.Fatalf("expected 4 attempts, got %d", len(stamps))
+	}
+	for i := 2; i < len(stamps); i++ {
+		prev, cur := stamps[i-1].Sub(stamps[i-2]), stamps[i].Sub(stamps[i-1])
+		if cur <= prev {
+			t.Errorf("expected growing intervals, got %v after %v", cur, prev)
+		}
+	}
+}
+
+func TestConfig_backoff(t *testing.T) {
+	config := NewConfig()
+	for attempt := 0; attempt < 3; attempt++ {
+		if wait := config.backoff(attempt); wait != time.Second {
+			t.Errorf("expected the fixed interval by default, got %v", wait)
+		}
+	}
+
+	config.RetryInterval = 100 * time.Millisecond
+	config.RetryBackoff = 2
+	config.RetryMaxInterval = time.Second
+	for attempt, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if wait := config.backoff(attempt); wait != expected*time.Millisecond {
+			t.Errorf("attempt %d: expected %v, got %v", attempt, expected*time.Millisecond, wait)
+		}
+	}
+
+	config.RetryJitter = 0.5
+	for i := 0; i < 100; i++ {
+		if wait := config.backoff(1); wait < 100*time.Millisecond || wait > 300*time.Millisecond {
+			t.Fatalf("expected 200ms ± 50%%, got %v", wait)
+		}
+	}
+}
+
+func TestRetry_errorSubstrings(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// hang up without a response, the client sees EOF
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	config.RetryErrorSubstrings = []string{"connection reset", "EOF"}
+	result, _, err := New(config).Get(ts.URL).Send()
+	if err != nil || string(result) != "ok" {
+		t.Errorf("expected the EOF retried, got %q %v", result, err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	config.RetryErrorSubstrings = []string{"connection refused"}
+	if _, _, err = New(config).Get(ts.URL).Send(); err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Errorf("expected the EOF error without retry, got %v", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 attempt, got %d", n)
+	}
+}
+
+func TestRetryStaleConnection(t *testing.T) {
+	var mu sync.Mutex
+	served := make(map[string]int)
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = ioutil.ReadAll(req.Body)
+		mu.Lock()
+		served[req.RemoteAddr]++
+		stale := served[req.RemoteAddr] > 1
+		mu.Unlock()
+		if stale {
+			// the server dropped the kept-alive connection, it hangs up
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("fresh"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	client := New(config).BaseURL(ts.URL)
+	if _, _, err := client.New().Put("/doc").BodyJSON("v1", false).Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the transport doesn't send a PUT again itself
+	result, code, err := client.New().Put("/doc").BodyJSON("v2", false).Send()
+	if err != nil || code != http.StatusOK || string(result) != "fresh" {
+		t.Errorf("expected the PUT sent again on a new connection, got %d %q %v", code, result, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+	if stats := client.PoolStats(); stats.ConnectionsCreated != 2 || stats.ConnectionsReused != 1 {
+		t.Errorf("expected the stale connection reused once and a new one dialed, got %+v", stats)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	if _, _, err = client.New().Post("/doc").BodyJSON("v3", false).Send(); err == nil {
+		t.Errorf("expected the POST not to be sent again")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected 1 attempt of the POST, got %d", n)
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			// hang up without a response, the client sees EOF
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_, _ = conn.Write([]byte("not HTTP\r\n\r\n"))
+			_ = conn.Close()
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	_, _, err := New(config).Get(ts.URL).Send()
+	retryErr, ok := err.(*RetryError)
+	if !ok {
+		t.Fatalf("expected *RetryError, got %T %v", err, err)
+	}
+	if retryErr.Attempts != 3 || len(retryErr.Errors) != 3 {
+		t.Fatalf("expected 3 attempts and errors, got %d %v", retryErr.Attempts, retryErr.Errors)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected the EOF of the first attempt, got %v", retryErr.Errors[0])
+	}
+	if got := retryErr.Errors[1].Error(); got != "503 Service Unavailable" {
+		t.Errorf("expected the status of the second attempt, got %s", got)
+	}
+	if got := retryErr.Errors[2].Error(); !strings.Contains(got, "malformed HTTP") {
+		t.Errorf("expected the malformed response of the last attempt, got %s", got)
+	}
+
+	// requests that aren't retried fail with their own error
+	atomic.StoreInt32(&attempts, 0)
+	if _, _, err = New().Get(ts.URL).Send(); !errors.Is(err, io.EOF) || errors.As(err, &retryErr) {
+		t.Errorf("expected the plain EOF, got %T %v", err, err)
+	}
+}
+
+func TestRetryError_attempts(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the retries of /wait wait long after the first one
+		if atomic.AddInt32(&attempts, 1) > 1 && req.URL.Path == "/wait" {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("busy"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 2
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+
+	// exhausted by failed statuses, the last body is returned too
+	result, code, err := New(config).Get(ts.URL).Send()
+	retryErr, ok := err.(*RetryError)
+	if !ok {
+		t.Fatalf("expected *RetryError, got %v", err)
+	}
+	if retryErr.Attempts != 3 || len(retryErr.Errors) != retryErr.Attempts {
+		t.Errorf("expected 3 attempts with an error each, got %d %v", retryErr.Attempts, retryErr.Errors)
+	}
+	if code != http.StatusServiceUnavailable || string(result) != "busy" {
+		t.Errorf("expected the last response, got %d %q", code, result)
+	}
+
+	// the context ends while waiting for the second retry
+	atomic.StoreInt32(&attempts, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, _, err = New(config).Get(ts.URL + "/wait").WithContext(ctx).Send()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected *RetryError, got %v", err)
+	}
+	if retryErr.Attempts != 2 || len(retryErr.Errors) != retryErr.Attempts {
+		t.Errorf("expected an error for each of the 2 attempts, got %d %v", retryErr.Attempts, retryErr.Errors)
+	}
+}
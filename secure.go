@@ -0,0 +1,68 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// WithSecureDefaults applies defaults suited to API clients:
+//
+//   - Accept: application/json, replaced by a later SetHeader("Accept", ...)
+//   - redirects from https to http are refused instead of followed
+//   - TLS 1.2 is the minimum version, unless Config.MinTLSVersion is higher
+//
+// The redirect and TLS settings apply to this Rattle and the ones created
+// from it by New, the parent keeps its own. The rattles of a client made
+// secure share their connections.
+func (r *Rattle) WithSecureDefaults() *Rattle {
+	r.header.Set("Accept", contentTypeJson)
+	client := *r.httpClient
+	client.CheckRedirect = refuseDowngrade(client.CheckRedirect)
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		// derived once, so the rattles made secure share the connections
+		client.Transport = r.transports.derive(transport, "secure", func(transport *http.Transport) {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			if transport.TLSClientConfig.MinVersion < tls.VersionTLS12 {
+				transport.TLSClientConfig.MinVersion = tls.VersionTLS12
+			}
+		})
+	}
+	r.httpClient = &client
+	return r
+}
+
+// refuseDowngrade wraps the redirect policy next, nil for the default one,
+// to refuse redirects from https to http.
+func refuseDowngrade(next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > 0 && via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" {
+			return fmt.Errorf("redirect from https to http refused: %s", req.URL.Redacted())
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
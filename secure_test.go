@@ -0,0 +1,95 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithSecureDefaults(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.Header.Get("Accept")))
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/downgrade" {
+			http.Redirect(w, req, plain.URL, http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte(req.Header.Get("Accept")))
+	}))
+	defer secure.Close()
+
+	parent := New()
+	rattle := parent.New().WithSecureDefaults()
+	result, _, err := rattle.Get(secure.URL).Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(result) != contentTypeJson {
+		t.Errorf("expected Accept %s, got %q", contentTypeJson, result)
+	}
+	if err = rattle.AssertMinTLS(tls.VersionTLS12); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	transport := rattle.httpClient.Transport.(*http.Transport)
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 minimum, got %#04x", transport.TLSClientConfig.MinVersion)
+	}
+
+	if _, _, err = rattle.New().Get(secure.URL + "/downgrade").Send(); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("expected the https to http redirect refused, got %v", err)
+	}
+	if _, _, err = parent.New().Get(secure.URL + "/downgrade").Send(); err != nil {
+		t.Errorf("expected the parent to keep following redirects, got %v", err)
+	}
+
+	// the defaults can be overridden
+	result, _, err = rattle.New().Get(plain.URL).SetHeader("Accept", "text/csv").Send()
+	if err != nil || string(result) != "text/csv" {
+		t.Errorf("expected overridden Accept text/csv, got %q %v", result, err)
+	}
+	config := NewConfig()
+	config.MinTLSVersion = tls.VersionTLS13
+	transport = New(config).WithSecureDefaults().httpClient.Transport.(*http.Transport)
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected the higher configured minimum kept, got %#04x", transport.TLSClientConfig.MinVersion)
+	}
+}
+
+func TestWithSecureDefaults_sharedPool(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	parent := New(config)
+	for i := 0; i < 2; i++ {
+		if _, _, err := parent.New().WithSecureDefaults().Get(ts.URL).Send(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if stats := parent.PoolStats(); stats.ConnectionsCreated != 1 || stats.ConnectionsReused != 1 {
+		t.Errorf("expected the secure rattles to share the connection, got %+v", stats)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ResourceMeta is the metadata of a resource, as told by the headers of a
+// HEAD response.
+type ResourceMeta struct {
+	// size of the resource, -1 if unknown
+	ContentLength int64
+	ContentType   string
+	// zero if the Last-Modified header is missing or invalid
+	LastModified time.Time
+	ETag         string
+}
+
+// Stat sends a HEAD request for path and returns the metadata of the
+// resource. Responses with a status >= 400 return an error. r is left as
+// is, the HEAD request is sent by a copy of it.
+func (r *Rattle) Stat(path string) (ResourceMeta, error) {
+	head := r.New().Head(path)
+	head.bodyProvider = nil
+	return head.resourceMeta()
+}
+
+// resourceMeta sends r and returns the metadata of the response.
+func (r *Rattle) resourceMeta() (ResourceMeta, error) {
+	_, code, err := r.Send()
+	if err != nil {
+		return ResourceMeta{}, err
+	}
+	if code >= 400 {
+		return ResourceMeta{}, fmt.Errorf("%s", r.resp.Status)
+	}
+	meta := ResourceMeta{
+		ContentLength: r.resp.ContentLength,
+		ContentType:   r.resp.Header.Get(contentType),
+		ETag:          r.resp.Header.Get("ETag"),
+	}
+	if lastModified, err := http.ParseTime(r.resp.Header.Get("Last-Modified")); err == nil {
+		meta.LastModified = lastModified
+	}
+	return meta, nil
+}
+
+// GetWithSizeLimit GETs path unless it's larger than max bytes. The size is
+// checked with a HEAD request first, and enforced while reading the body in
+// case the server doesn't know it or tells otherwise. Oversized resources
+// return an error. r is left as is, the requests are sent by copies of it.
+func (r *Rattle) GetWithSizeLimit(path string, max int64) ([]byte, int, error) {
+	head := r.New().Head(path)
+	head.bodyProvider = nil
+	meta, err := head.resourceMeta()
+	if err != nil {
+		return nil, 0, err
+	}
+	if meta.ContentLength > max {
+		return nil, head.resp.StatusCode, fmt.Errorf("content length %d exceeds limit %d", meta.ContentLength, max)
+	}
+	get := r.New().Get(path)
+	get.bodyProvider = nil
+	body, code, err := get.SendStream()
+	if err != nil {
+		return nil, code, err
+	}
+	defer body.Close()
+	result, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, code, err
+	}
+	if int64(len(result)) > max {
+		return nil, code, fmt.Errorf("body exceeds limit %d", max)
+	}
+	return result, code, nil
+}
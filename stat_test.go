@@ -0,0 +1,107 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStat(t *testing.T) {
+	modified := time.Date(2018, 10, 1, 8, 30, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != HEAD {
+			t.Errorf("expected method %s, got %s", HEAD, req.Method)
+		}
+		if req.URL.Path != "/files/report.pdf" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Length", "2048")
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"v42"`)
+	}))
+	defer ts.Close()
+
+	meta, err := New().BaseURL(ts.URL).Stat("/files/report.pdf")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := ResourceMeta{ContentLength: 2048, ContentType: "application/pdf", LastModified: modified, ETag: `"v42"`}
+	if meta != expected {
+		t.Errorf("expected %+v, got %+v", expected, meta)
+	}
+
+	if _, err = New().BaseURL(ts.URL).Stat("/missing"); err == nil {
+		t.Errorf("expected error for a missing resource")
+	}
+
+	client := New().BaseURL(ts.URL+"/api/").Post("items").BodyJSON(testItem{ID: 1}, false)
+	if _, err = client.Stat("/files/report.pdf"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if client.method != POST || client.rawURL != ts.URL+"/api/items" || client.bodyProvider == nil {
+		t.Errorf("expected the client left unchanged, got %s %s", client.method, client.rawURL)
+	}
+}
+
+func TestGetWithSizeLimit(t *testing.T) {
+	var gets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == GET {
+			atomic.AddInt32(&gets, 1)
+		}
+		switch req.URL.Path {
+		case "/files/large":
+			w.Header().Set("Content-Length", "1073741824")
+		case "/files/lying":
+			// tells nothing on HEAD, sends more than the limit on GET
+			w.Header().Set("Transfer-Encoding", "chunked")
+			if req.Method == GET {
+				_, _ = w.Write(bytes.Repeat([]byte("x"), 2048))
+			}
+		default:
+			_, _ = w.Write([]byte("small"))
+		}
+	}))
+	defer ts.Close()
+
+	if _, _, err := New().BaseURL(ts.URL+"/files/").GetWithSizeLimit("large", 1024); err == nil {
+		t.Errorf("expected error for a large resource")
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Errorf("expected the GET skipped, got %d", n)
+	}
+
+	client := New().BaseURL(ts.URL+"/files/").Post("upload").BodyJSON(testItem{ID: 1}, false)
+	result, code, err := client.GetWithSizeLimit("small", 1024)
+	if err != nil || code != http.StatusOK || string(result) != "small" {
+		t.Errorf("expected the small resource, got %d %q %v", code, result, err)
+	}
+	if client.method != POST || client.rawURL != ts.URL+"/files/upload" || client.bodyProvider == nil {
+		t.Errorf("expected the client left unchanged, got %s %s", client.method, client.rawURL)
+	}
+
+	if _, _, err = New().BaseURL(ts.URL+"/files/").GetWithSizeLimit("lying", 1024); err == nil {
+		t.Errorf("expected error for a body beyond the limit")
+	}
+}
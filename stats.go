@@ -0,0 +1,207 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSLAViolation is returned with the response by Do when the request took
+// longer than allowed by WithMaxLatency.
+var ErrSLAViolation = errors.New("request exceeded its maximum latency")
+
+// Stats holds the measurements of the last request sent by Do.
+type Stats struct {
+	// wall time of Do, from sending the request to reading the whole body
+	TotalTime time.Duration
+	// size of the response body read
+	BytesRead int64
+	// size of the request body sent by the last attempt
+	BytesWritten int64
+	// BytesRead per second of TotalTime
+	ThroughputBytesPerSec float64
+	// remote address of the connection of the last attempt, e.g. the IP a
+	// load balanced host name resolved to
+	RemoteAddr string
+	// time spent resolving the host name, summed over the attempts
+	DNSLookupTime time.Duration
+	// attempts retried after the first one, see Config.RetryTimes
+	Retries int
+	// time of the last attempt until its response headers arrived
+	LastAttemptTime time.Duration
+}
+
+// Stats returns the measurements of the last request sent by Do.
+func (r *Rattle) Stats() Stats {
+	return r.stats
+}
+
+// PoolStats counts the connections of a client over its lifetime, to tune
+// the reuse of connections, see Config.ReUseTCP.
+type PoolStats struct {
+	// connections dialed for requests
+	ConnectionsCreated int64
+	// requests sent on idle connections of earlier ones
+	ConnectionsReused int64
+	// requests sent by Do or SendStream, retries not counted
+	Requests int64
+}
+
+// poolCounters are the PoolStats shared by a client's rattles.
+type poolCounters struct {
+	created, reused, requests int64
+}
+
+// PoolStats returns the connection counters of the client of r, shared with
+// the rattles created by New.
+func (r *Rattle) PoolStats() PoolStats {
+	if r.pool == nil {
+		return PoolStats{}
+	}
+	return PoolStats{
+		ConnectionsCreated: atomic.LoadInt64(&r.pool.created),
+		ConnectionsReused:  atomic.LoadInt64(&r.pool.reused),
+		Requests:           atomic.LoadInt64(&r.pool.requests),
+	}
+}
+
+// traceStats counts req in the PoolStats and returns it traced to fill the
+// connection stats, and a func copying the timings and body size measured by
+// the dialing and writing goroutines into the stats, to call once the
+// response is in.
+func (r *Rattle) traceStats(req *http.Request) (*http.Request, func()) {
+	if r.pool != nil {
+		atomic.AddInt64(&r.pool.requests, 1)
+	}
+	var (
+		mu       sync.Mutex
+		dnsStart time.Time
+		dnsTime  time.Duration
+		written  int64
+	)
+	req = countWritten(req, &written)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			dnsTime += time.Since(dnsStart)
+			mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.stats.RemoteAddr = info.Conn.RemoteAddr().String()
+			if r.pool == nil {
+				return
+			}
+			if info.Reused {
+				atomic.AddInt64(&r.pool.reused, 1)
+			} else {
+				atomic.AddInt64(&r.pool.created, 1)
+			}
+		},
+	}))
+	return req, func() {
+		mu.Lock()
+		r.stats.DNSLookupTime = dnsTime
+		mu.Unlock()
+		r.stats.BytesWritten = atomic.LoadInt64(&written)
+	}
+}
+
+// countWritten returns req counting the bytes of its body read by the
+// transport into n. Each body sent again starts over.
+func countWritten(req *http.Request, n *int64) *http.Request {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+	req = req.WithContext(req.Context())
+	req.Body = &countingBody{body: req.Body, n: n}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			atomic.StoreInt64(n, 0)
+			return &countingBody{body: body, n: n}, nil
+		}
+	}
+	return req
+}
+
+// countingBody counts the bytes read from body.
+type countingBody struct {
+	body io.ReadCloser
+	n    *int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countingBody) Close() error {
+	return c.body.Close()
+}
+
+// finish completes the stats of a request started at start.
+func (s *Stats) finish(start time.Time, bytesRead int) {
+	s.TotalTime = time.Since(start)
+	s.BytesRead = int64(bytesRead)
+	if s.TotalTime > 0 {
+		s.ThroughputBytesPerSec = float64(s.BytesRead) / s.TotalTime.Seconds()
+	}
+}
+
+// WithMaxLatency makes Do return ErrSLAViolation, along with the result,
+// when a request including the retries takes longer than d. The request
+// itself isn't aborted, see Timeout for that.
+func (r *Rattle) WithMaxLatency(d time.Duration) *Rattle {
+	r.maxLatency = d
+	return r
+}
+
+// checkLatency returns ErrSLAViolation if the last request took longer than
+// allowed by WithMaxLatency.
+func (r *Rattle) checkLatency() error {
+	if r.maxLatency <= 0 || r.stats.TotalTime <= r.maxLatency {
+		return nil
+	}
+	return fmt.Errorf("%w: took %v, allowed %v", ErrSLAViolation, r.stats.TotalTime, r.maxLatency)
+}
+
+// reportSlow calls Config.SlowRequestHandler if the last request took longer
+// than Config.SlowRequestThreshold.
+func (r *Rattle) reportSlow(req *http.Request) {
+	if r.config.SlowRequestHandler == nil || r.config.SlowRequestThreshold <= 0 {
+		return
+	}
+	if r.stats.TotalTime > r.config.SlowRequestThreshold {
+		r.config.SlowRequestHandler(req, r.stats.TotalTime)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStats_throughput(t *testing.T) {
+	const chunks, chunkSize = 8, 8 << 10
+	const delay = 20 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// limit the bandwidth to chunkSize per delay
+		for i := 0; i < chunks; i++ {
+			_, _ = w.Write(bytes.Repeat([]byte("x"), chunkSize))
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+		}
+	}))
+	defer ts.Close()
+
+	rattle := New().Get(ts.URL)
+	result, _, err := rattle.Send()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stats := rattle.Stats()
+	if stats.BytesRead != chunks*chunkSize || len(result) != chunks*chunkSize {
+		t.Errorf("expected %d bytes read, got %d", chunks*chunkSize, stats.BytesRead)
+	}
+	if stats.TotalTime < (chunks-1)*delay {
+		t.Errorf("expected total time of at least %v, got %v", (chunks-1)*delay, stats.TotalTime)
+	}
+	expected := float64(stats.BytesRead) / stats.TotalTime.Seconds()
+	if math.Abs(stats.ThroughputBytesPerSec-expected) > 1 {
+		t.Errorf("expected throughput %f, got %f", expected, stats.ThroughputBytesPerSec)
+	}
+	limit := float64(chunks*chunkSize) / ((chunks - 1) * delay).Seconds()
+	if stats.ThroughputBytesPerSec > limit || stats.ThroughputBytesPerSec < limit/4 {
+		t.Errorf("expected throughput within the server limit %f, got %f", limit, stats.ThroughputBytesPerSec)
+	}
+}
+
+func TestStats_bytesWritten(t *testing.T) {
+	const size = 10000
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, req.Body)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	rattle := New(config).Post(ts.URL).BodyOriginal(bytes.NewReader(bytes.Repeat([]byte("w"), size)))
+	if _, code, err := rattle.Send(); err != nil || code != http.StatusOK {
+		t.Fatalf("unexpected result %d %v", code, err)
+	}
+	if stats := rattle.Stats(); stats.BytesWritten != size || stats.Retries != 1 {
+		t.Errorf("expected %d bytes written by the last attempt, got %d after %d retries", size, stats.BytesWritten, stats.Retries)
+	}
+
+	rattle = New().Get(ts.URL)
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if written := rattle.Stats().BytesWritten; written != 0 {
+		t.Errorf("expected no bytes written without body, got %d", written)
+	}
+}
+
+func TestSlowRequestHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	var slowURL string
+	var slowDur time.Duration
+	config := NewConfig()
+	config.SlowRequestThreshold = 50 * time.Millisecond
+	config.SlowRequestHandler = func(req *http.Request, dur time.Duration) {
+		slowURL = req.URL.String()
+		slowDur = dur
+	}
+
+	if _, _, err := New(config).Get(ts.URL + "/fast").Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if slowURL != "" {
+		t.Errorf("expected fast request not to be reported, got %s", slowURL)
+	}
+
+	rattle := New(config).Get(ts.URL + "/slow")
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if slowURL != ts.URL+"/slow" {
+		t.Errorf("expected slow request to be reported, got %q", slowURL)
+	}
+	if slowDur < 100*time.Millisecond || slowDur != rattle.Stats().TotalTime {
+		t.Errorf("expected duration %v of at least 100ms, got %v", rattle.Stats().TotalTime, slowDur)
+	}
+}
+
+func TestStats_remoteAddr(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	rattle := New().Get(ts.URL)
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if addr := rattle.Stats().RemoteAddr; addr != ts.Listener.Addr().String() {
+		t.Errorf("expected remote address %s, got %q", ts.Listener.Addr(), addr)
+	}
+}
+
+// serveDNS answers the A queries received on conn with 127.0.0.1, and
+// other queries with no records.
+func serveDNS(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		// the question ends with its type and class after the name
+		end := 12
+		for end < n && buf[end] != 0 {
+			end += int(buf[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(buf[end-4:])
+		resp := append([]byte{}, buf[:end]...)
+		resp[2], resp[3] = 0x81, 0x80
+		binary.BigEndian.PutUint16(resp[6:], 0)
+		binary.BigEndian.PutUint16(resp[8:], 0)
+		binary.BigEndian.PutUint16(resp[10:], 0)
+		if qtype == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+		}
+		_, _ = conn.WriteTo(resp, addr)
+	}
+}
+
+func TestStats_dnsLookupTime(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer dns.Close()
+	go serveDNS(dns)
+
+	const delay = 30 * time.Millisecond
+	config := NewConfig()
+	config.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			time.Sleep(delay)
+			return net.Dial("udp", dns.LocalAddr().String())
+		},
+	}
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	rattle := New(config).Get("http://rattle.test:" + port)
+	if _, _, err = rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if dnsTime := rattle.Stats().DNSLookupTime; dnsTime < delay {
+		t.Errorf("expected DNS lookup time of at least %v, got %v", delay, dnsTime)
+	}
+
+	// no lookup for IP addresses
+	rattle = New().Get(ts.URL)
+	if _, _, err = rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if dnsTime := rattle.Stats().DNSLookupTime; dnsTime != 0 {
+		t.Errorf("expected no DNS lookup time, got %v", dnsTime)
+	}
+}
+
+func TestWithMaxLatency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer ts.Close()
+
+	result, code, err := New().Get(ts.URL + "/slow").WithMaxLatency(20 * time.Millisecond).Send()
+	if !errors.Is(err, ErrSLAViolation) {
+		t.Errorf("expected ErrSLAViolation, got %v", err)
+	}
+	if code != http.StatusOK || string(result) != "body" {
+		t.Errorf("expected the successful body along the error, got %d %q", code, result)
+	}
+
+	if _, _, err = New().Get(ts.URL + "/fast").WithMaxLatency(time.Second).Send(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestStats_retries(t *testing.T) {
+	const delay = 40 * time.Millisecond
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 3
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	rattle := New(config).Get(ts.URL)
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	stats := rattle.Stats()
+	if stats.Retries != 1 {
+		t.Errorf("expected 1 retry, got %d", stats.Retries)
+	}
+	if stats.TotalTime < 2*delay {
+		t.Errorf("expected total time of at least %v, got %v", 2*delay, stats.TotalTime)
+	}
+	if stats.LastAttemptTime < delay || stats.LastAttemptTime >= stats.TotalTime {
+		t.Errorf("expected last attempt time between %v and %v, got %v", delay, stats.TotalTime, stats.LastAttemptTime)
+	}
+
+	// stats are reset per request
+	rattle = rattle.New()
+	if _, _, err := rattle.Send(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if stats = rattle.Stats(); stats.Retries != 0 {
+		t.Errorf("expected no retry, got %d", stats.Retries)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.ReUseTCP = true
+	parent := New(config).Get(ts.URL)
+	for i := 0; i < 5; i++ {
+		if _, _, err := parent.New().Send(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	expected := PoolStats{ConnectionsCreated: 1, ConnectionsReused: 4, Requests: 5}
+	if stats := parent.PoolStats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	// without reuse every request dials
+	rattle := New().Get(ts.URL)
+	for i := 0; i < 3; i++ {
+		if _, _, err := rattle.Send(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	expected = PoolStats{ConnectionsCreated: 3, ConnectionsReused: 0, Requests: 3}
+	if stats := rattle.PoolStats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
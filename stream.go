@@ -0,0 +1,91 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"io"
+	"time"
+)
+
+// SendStream sends the request like Send, with the same retries, but
+// returns the live response body instead of reading it into memory, for
+// large downloads. The caller must close the body. Stats are completed
+// when it is closed, a Timeout covers reading it as well.
+func (r *Rattle) SendStream() (io.ReadCloser, int, error) {
+	req, err := r.GetRequest()
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	r.stats = Stats{}
+	req, cancel := r.withTimeout(req)
+	req = r.withBodyDeadline(req, start)
+	req, traced := r.traceStats(req)
+	req, release := r.hookConns(req)
+	resp, err := r.roundTrip(req, start)
+	traced()
+	if err != nil {
+		code := 0
+		if resp != nil {
+			// the last response of exhausted retries, see RetryError
+			code = resp.StatusCode
+			discardResponse(resp)
+		}
+		cancel()
+		release()
+		r.stats.finish(start, 0)
+		return nil, code, err
+	}
+	r.resp = resp
+	if err = decompressResponse(resp); err != nil {
+		_ = resp.Body.Close()
+		cancel()
+		release()
+		r.stats.finish(start, 0)
+		return nil, resp.StatusCode, err
+	}
+	body := &streamBody{ReadCloser: resp.Body}
+	body.done = func() {
+		cancel()
+		release()
+		r.stats.finish(start, body.n)
+	}
+	return body, resp.StatusCode, nil
+}
+
+// streamBody counts the bytes read from a streamed response body and calls
+// done once it is closed.
+type streamBody struct {
+	io.ReadCloser
+	n    int
+	done func()
+}
+
+func (s *streamBody) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.n += n
+	return n, err
+}
+
+func (s *streamBody) Close() error {
+	err := s.ReadCloser.Close()
+	if s.done != nil {
+		s.done()
+		s.done = nil
+	}
+	return err
+}
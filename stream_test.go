@@ -0,0 +1,112 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendStream(t *testing.T) {
+	const size = 8 << 20
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var written int64
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		for sent := 0; sent < size; sent += len(chunk) {
+			n, err := w.Write(chunk)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	rattle := New(config).Get(ts.URL)
+	body, code, err := rattle.SendStream()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("expected status 200 after the retry, got %d", code)
+	}
+	// the server is blocked on the unread body, far from done
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&written); n >= size {
+		t.Errorf("expected the body not buffered by rattle, server wrote %d bytes", n)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, body)
+	if err != nil || n != size {
+		t.Errorf("expected %d bytes copied, got %d %v", size, n, err)
+	}
+	if err = body.Close(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	expected := sha256.New()
+	for sent := 0; sent < size; sent += len(chunk) {
+		expected.Write(chunk)
+	}
+	if !bytes.Equal(hash.Sum(nil), expected.Sum(nil)) {
+		t.Errorf("expected the streamed body intact")
+	}
+	if stats := rattle.Stats(); stats.BytesRead != size {
+		t.Errorf("expected %d bytes in stats, got %d", size, stats.BytesRead)
+	}
+}
+
+func TestSendStream_retryError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("busy"))
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	rattle := New(config).Get(ts.URL)
+	body, code, err := rattle.SendStream()
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected *RetryError, got %v", err)
+	}
+	if body != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("expected no body and the last status, got %v %d", body, code)
+	}
+	if !waitFor(func() bool { return rattle.OpenConnections() == 0 }) {
+		t.Errorf("expected the connections closed, got %d", rattle.OpenConnections())
+	}
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"golang.org/x/net/context"
+)
+
+const traceParent = "traceparent"
+
+// traceParentKey is the context key of the W3C traceparent, see
+// ContextWithTraceParent.
+type traceParentKey struct{}
+
+// traceParentFormat matches version 00 traceparent values with non-zero ids.
+var traceParentFormat = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// ContextWithTraceParent returns a copy of ctx carrying the W3C traceparent
+// value of the current span, to be propagated by WithTraceContext.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceparent)
+}
+
+// TraceParentFromContext returns the valid W3C traceparent carried by ctx.
+func TraceParentFromContext(ctx context.Context) (string, bool) {
+	traceparent, _ := ctx.Value(traceParentKey{}).(string)
+	return traceparent, validTraceParent(traceparent)
+}
+
+// WithTraceContext sets the W3C traceparent header of the request to the one
+// carried by ctx, see ContextWithTraceParent. Without a valid one a new
+// trace is started, with random trace and parent ids and sampled set.
+func (r *Rattle) WithTraceContext(ctx context.Context) *Rattle {
+	traceparent, ok := TraceParentFromContext(ctx)
+	if !ok {
+		traceparent = newTraceParent()
+	}
+	return r.SetHeader(traceParent, traceparent)
+}
+
+// validTraceParent reports whether traceparent is a well-formed version 00
+// value, whose ids aren't all zeros.
+func validTraceParent(traceparent string) bool {
+	m := traceParentFormat.FindStringSubmatch(traceparent)
+	return m != nil && m[1] != "00000000000000000000000000000000" && m[2] != "0000000000000000"
+}
+
+// newTraceParent returns a traceparent starting a new sampled trace.
+func newTraceParent() string {
+	ids := make([]byte, 24)
+	_, _ = rand.Read(ids)
+	return "00-" + hex.EncodeToString(ids[:16]) + "-" + hex.EncodeToString(ids[16:]) + "-01"
+}
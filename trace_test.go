@@ -0,0 +1,64 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithTraceContext(t *testing.T) {
+	req, err := New().Get("http://example.com").WithTraceContext(context.Background()).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	generated := req.Header.Get("traceparent")
+	if !validTraceParent(generated) {
+		t.Errorf("expected a well-formed traceparent, got %q", generated)
+	}
+	req, _ = New().Get("http://example.com").WithTraceContext(context.Background()).GetRequest()
+	if other := req.Header.Get("traceparent"); other == generated {
+		t.Errorf("expected a new trace per request, got %q twice", other)
+	}
+
+	const existing = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := ContextWithTraceParent(context.Background(), existing)
+	req, err = New().Get("http://example.com").WithTraceContext(ctx).GetRequest()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := req.Header.Get("traceparent"); got != existing {
+		t.Errorf("expected the traceparent of the context %s, got %s", existing, got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		ctx = ContextWithTraceParent(context.Background(), invalid)
+		if _, ok := TraceParentFromContext(ctx); ok {
+			t.Errorf("expected %q invalid", invalid)
+		}
+		req, _ = New().Get("http://example.com").WithTraceContext(ctx).GetRequest()
+		if got := req.Header.Get("traceparent"); got == invalid || !validTraceParent(got) {
+			t.Errorf("expected a new traceparent instead of %q, got %q", invalid, got)
+		}
+	}
+}
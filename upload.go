@@ -0,0 +1,89 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+const contentTypeOctetStream = "application/octet-stream"
+
+// UploadChunked streams the file at path as the request body, with chunked
+// transfer encoding instead of reading it into memory. onChunk is called
+// with the SHA-256 of every chunkSize bytes sent, and of the rest at the
+// end, so the upload can be verified chunk by chunk. The file is read again
+// from the start when the request is sent again, on retries or 307/308
+// redirects, and the indices then restart from 0: the sums of the last run
+// belong to the request that completed.
+func (r *Rattle) UploadChunked(path string, chunkSize int, onChunk func(index int, sum []byte)) *Rattle {
+	if chunkSize <= 0 {
+		return r.setErr(fmt.Errorf("chunk size %d not positive", chunkSize))
+	}
+	return r.setbodyProvider(bodyProviderChunked{path: path, chunkSize: chunkSize, onChunk: onChunk})
+}
+
+// bodyProviderChunked streams a file as Body for requests, hashing its
+// chunks.
+type bodyProviderChunked struct {
+	path      string
+	chunkSize int
+	onChunk   func(index int, sum []byte)
+}
+
+func (p bodyProviderChunked) GetBody() (io.Reader, string, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, "", err
+	}
+	return &chunkHashReader{file: file, chunkSize: p.chunkSize, onChunk: p.onChunk, hash: sha256.New()}, contentTypeOctetStream, nil
+}
+
+// chunkHashReader reads file, hashing every chunkSize bytes.
+type chunkHashReader struct {
+	file      *os.File
+	chunkSize int
+	onChunk   func(index int, sum []byte)
+	hash      hash.Hash
+	filled    int
+	index     int
+}
+
+func (c *chunkHashReader) Read(p []byte) (int, error) {
+	if rest := c.chunkSize - c.filled; len(p) > rest {
+		p = p[:rest]
+	}
+	n, err := c.file.Read(p)
+	c.hash.Write(p[:n])
+	c.filled += n
+	if c.filled == c.chunkSize || (err == io.EOF && c.filled > 0) {
+		if c.onChunk != nil {
+			c.onChunk(c.index, c.hash.Sum(nil))
+		}
+		c.index++
+		c.filled = 0
+		c.hash.Reset()
+	}
+	return n, err
+}
+
+func (c *chunkHashReader) Close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright [2018] [Chen.Yu]
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rattle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadChunked(t *testing.T) {
+	const chunkSize = 4096
+	content := bytes.Repeat([]byte("rattle chunked upload\n"), 1000)
+	path := filepath.Join(t.TempDir(), "upload.txt")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var received []byte
+	var encoding []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding = req.TransferEncoding
+		received, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer ts.Close()
+
+	var sums [][]byte
+	_, code, err := New().Post(ts.URL).UploadChunked(path, chunkSize, func(index int, sum []byte) {
+		if index != len(sums) {
+			t.Errorf("expected chunk %d, got %d", len(sums), index)
+		}
+		sums = append(sums, sum)
+	}).Send()
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("unexpected result %d %v", code, err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Errorf("expected the file uploaded, got %d of %d bytes", len(received), len(content))
+	}
+	if !reflect.DeepEqual(encoding, []string{"chunked"}) {
+		t.Errorf("expected chunked transfer encoding, got %v", encoding)
+	}
+
+	var expected [][]byte
+	for start := 0; start < len(content); start += chunkSize {
+		end := start + chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha256.Sum256(content[start:end])
+		expected = append(expected, sum[:])
+	}
+	if !reflect.DeepEqual(expected, sums) {
+		t.Errorf("expected %d chunk hashes matching the file, got %d", len(expected), len(sums))
+	}
+
+	if _, err = New().Post(ts.URL).UploadChunked(path, 0, nil).GetRequest(); err == nil {
+		t.Errorf("expected error for a chunk size of 0")
+	}
+	if _, err = New().Post(ts.URL).UploadChunked(path+".missing", chunkSize, nil).GetRequest(); err == nil {
+		t.Errorf("expected error for a missing file")
+	}
+}
+
+func TestUploadChunked_retry(t *testing.T) {
+	const chunkSize = 4096
+	content := bytes.Repeat([]byte("retried upload\n"), 1000)
+	path := filepath.Join(t.TempDir(), "upload.txt")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var attempts int32
+	var received []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ = ioutil.ReadAll(req.Body)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	config := NewConfig()
+	config.RetryTimes = 1
+	config.RetryInterval = time.Millisecond
+	config.RetryStatusCodes = []int{http.StatusServiceUnavailable}
+	var indices []int
+	_, code, err := New(config).Post(ts.URL).UploadChunked(path, chunkSize, func(index int, sum []byte) {
+		indices = append(indices, index)
+	}).Send()
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("unexpected result %d %v", code, err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Errorf("expected the file uploaded again, got %d of %d bytes", len(received), len(content))
+	}
+
+	// the indices restart with the retry
+	chunks := (len(content) + chunkSize - 1) / chunkSize
+	var expected []int
+	for run := 0; run < 2; run++ {
+		for i := 0; i < chunks; i++ {
+			expected = append(expected, i)
+		}
+	}
+	if !reflect.DeepEqual(expected, indices) {
+		t.Errorf("expected the indices %v, got %v", expected, indices)
+	}
+}